@@ -14,35 +14,413 @@
 
 package v1alpha1
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
 type EnvoyConfig struct {
 	Name string `yaml:"name"`
 	Spec `yaml:"spec"`
 }
 
 type Spec struct {
-	Listeners []Listener `yaml:"listeners"`
-	Clusters  []Cluster  `yaml:"clusters"`
+	Nodes     Nodes          `yaml:"nodes"`
+	Listeners []Listener     `yaml:"listeners"`
+	Clusters  []Cluster      `yaml:"clusters"`
+	Secrets   []Secret       `yaml:"secrets"`
+	Runtime   []RuntimeLayer `yaml:"runtime"`
+}
+
+// RuntimeLayer is served to Envoy over RTDS as the runtime layer Name, which
+// the Envoy bootstrap must list as an rtds_layer. Values hold booleans,
+// numbers and strings keyed by runtime key; FractionalPercents hold the
+// runtime keys read as fractional percentages, such as those gating routes.
+type RuntimeLayer struct {
+	Name               string                       `yaml:"name"`
+	Values             map[string]interface{}       `yaml:"values"`
+	FractionalPercents map[string]FractionalPercent `yaml:"fractionalPercents"`
+}
+
+// FractionalPercent is Numerator out of Denominator, which is one of
+// hundred (the default), ten_thousand or million.
+type FractionalPercent struct {
+	Numerator   uint32 `yaml:"numerator"`
+	Denominator string `yaml:"denominator"`
+}
+
+// Secret is served to Envoy over SDS under Name, for listeners and clusters
+// to reference. It is either a certificate, loaded from the PEM encoded
+// CertificateChain and PrivateKey files, or a CA bundle used to validate
+// peer certificates, loaded from the PEM encoded TrustedCA file. Relative
+// paths are relative to the config file's directory.
+type Secret struct {
+	Name             string `yaml:"name"`
+	CertificateChain string `yaml:"certificateChain"`
+	PrivateKey       string `yaml:"privateKey"`
+	TrustedCA        string `yaml:"trustedCA"`
 }
 
+// Nodes selects the Envoy nodes a config is served to, by node ID or by
+// Envoy node cluster. A config that selects no nodes is served to all of them.
+type Nodes struct {
+	IDs      []string `yaml:"ids"`
+	Clusters []string `yaml:"clusters"`
+}
+
+// Listener accepts connections on Address and Port. A listener's Protocol
+// is http by default, routing requests with its Routes and VirtualHosts, or
+// tcp, proxying connections to its Clusters and closing them after
+// IdleTimeout without activity. AccessLog is the file that connections or
+// requests are logged to.
 type Listener struct {
-	Name    string  `yaml:"name"`
-	Address string  `yaml:"address"`
-	Port    uint32  `yaml:"port"`
-	Routes  []Route `yaml:"routes"`
+	Name         string         `yaml:"name"`
+	Address      string         `yaml:"address"`
+	Port         uint32         `yaml:"port"`
+	Protocol     string         `yaml:"protocol"`
+	Routes       []Route        `yaml:"routes"`
+	VirtualHosts []VirtualHost  `yaml:"virtualHosts"`
+	Clusters     []RouteCluster `yaml:"clusters"`
+	IdleTimeout  *time.Duration `yaml:"idleTimeout"`
+	AccessLog    string         `yaml:"accessLog"`
+	TLS          *DownstreamTLS `yaml:"tls"`
+}
+
+// DownstreamTLS terminates TLS on a listener with the certificates named by
+// CertificateSecrets. Client certificates are validated against the CA
+// bundle named by ClientCASecret, and only required when
+// RequireClientCertificate is set. MinVersion and MaxVersion are one of
+// 1.0, 1.1, 1.2 or 1.3; CipherSuites and ALPN default to Envoy's choices.
+type DownstreamTLS struct {
+	CertificateSecrets       []string `yaml:"certificateSecrets"`
+	ClientCASecret           string   `yaml:"clientCASecret"`
+	RequireClientCertificate bool     `yaml:"requireClientCertificate"`
+	MinVersion               string   `yaml:"minVersion"`
+	MaxVersion               string   `yaml:"maxVersion"`
+	CipherSuites             []string `yaml:"cipherSuites"`
+	ALPN                     []string `yaml:"alpn"`
 }
 
+// VirtualHost groups the routes served for a set of domains. A domain is a
+// host name, optionally with a port, and may start or end with a "*"
+// wildcard. A listener's own routes are served for every domain ("*").
+// The timeouts and retry policy apply to every route of the virtual host
+// that does not set its own.
+type VirtualHost struct {
+	Name        string         `yaml:"name"`
+	Domains     []string       `yaml:"domains"`
+	Routes      []Route        `yaml:"routes"`
+	Timeout     *time.Duration `yaml:"timeout"`
+	IdleTimeout *time.Duration `yaml:"idleTimeout"`
+	RetryPolicy *RetryPolicy   `yaml:"retryPolicy"`
+}
+
+// Route matches requests and either forwards them to its clusters, answers
+// them with a redirect, or answers them with a direct response. At most one
+// of Prefix, Path, Regex and PathSeparatedPrefix may be set; a route with
+// none of them matches every path. All of the other conditions given must
+// match as well. The rewrites, timeouts and retry policy only apply to
+// forwarded requests. A zero timeout disables it.
 type Route struct {
-	Name         string   `yaml:"name"`
-	Prefix       string   `yaml:"prefix"`
-	ClusterNames []string `yaml:"clusters"`
+	Name                string            `yaml:"name"`
+	Prefix              string            `yaml:"prefix"`
+	Path                string            `yaml:"path"`
+	Regex               string            `yaml:"regex"`
+	PathSeparatedPrefix string            `yaml:"pathSeparatedPrefix"`
+	CaseSensitive       *bool             `yaml:"caseSensitive"`
+	Methods             []string          `yaml:"methods"`
+	Headers             []HeaderMatch     `yaml:"headers"`
+	QueryParams         []QueryParamMatch `yaml:"queryParams"`
+	Clusters            []RouteCluster    `yaml:"clusters"`
+	Redirect            *Redirect         `yaml:"redirect"`
+	DirectResponse      *DirectResponse   `yaml:"directResponse"`
+	PrefixRewrite       string            `yaml:"prefixRewrite"`
+	RegexRewrite        *RegexRewrite     `yaml:"regexRewrite"`
+	HostRewrite         string            `yaml:"hostRewrite"`
+	Timeout             *time.Duration    `yaml:"timeout"`
+	IdleTimeout         *time.Duration    `yaml:"idleTimeout"`
+	RetryPolicy         *RetryPolicy      `yaml:"retryPolicy"`
+}
+
+// RetryPolicy retries forwarded requests that fail with one of the RetryOn
+// conditions, which are Envoy's x-envoy-retry-on and x-envoy-retry-grpc-on
+// values such as 5xx, reset, connect-failure or unavailable. Listing
+// RetriableStatusCodes also retries responses with those status codes.
+type RetryPolicy struct {
+	RetryOn              []string       `yaml:"retryOn"`
+	NumRetries           *uint32        `yaml:"numRetries"`
+	PerTryTimeout        *time.Duration `yaml:"perTryTimeout"`
+	BackOff              *RetryBackOff  `yaml:"backOff"`
+	RetriableStatusCodes []uint32       `yaml:"retriableStatusCodes"`
+}
+
+// RetryBackOff sets the exponential back off between retries. MaxInterval
+// defaults to ten times BaseInterval.
+type RetryBackOff struct {
+	BaseInterval time.Duration `yaml:"baseInterval"`
+	MaxInterval  time.Duration `yaml:"maxInterval"`
+}
+
+// Redirect answers a request with an HTTP redirect. Any part of the
+// request URL that is not overridden is kept. At most one of Path and
+// PrefixRewrite may be set. ResponseCode defaults to 301.
+type Redirect struct {
+	Scheme        string `yaml:"scheme"`
+	Host          string `yaml:"host"`
+	Port          uint32 `yaml:"port"`
+	Path          string `yaml:"path"`
+	PrefixRewrite string `yaml:"prefixRewrite"`
+	ResponseCode  uint32 `yaml:"responseCode"`
+	StripQuery    bool   `yaml:"stripQuery"`
+}
+
+// DirectResponse answers a request with a fixed status and body. The body
+// is given inline or read from BodyFile, which is relative to the config
+// file's directory.
+type DirectResponse struct {
+	Status   uint32 `yaml:"status"`
+	Body     string `yaml:"body"`
+	BodyFile string `yaml:"bodyFile"`
+}
+
+// RegexRewrite replaces the parts of the path matching Pattern with
+// Substitution, which may refer to capture groups as \1, \2 and so on.
+type RegexRewrite struct {
+	Pattern      string `yaml:"pattern"`
+	Substitution string `yaml:"substitution"`
+}
+
+// HeaderMatch matches a request header by exact value or regex. When
+// neither is set the header only has to be present. Invert negates the match.
+type HeaderMatch struct {
+	Name   string `yaml:"name"`
+	Exact  string `yaml:"exact"`
+	Regex  string `yaml:"regex"`
+	Invert bool   `yaml:"invert"`
+}
+
+// QueryParamMatch matches a query parameter by exact value or regex. When
+// neither is set the parameter only has to be present.
+type QueryParamMatch struct {
+	Name  string `yaml:"name"`
+	Exact string `yaml:"exact"`
+	Regex string `yaml:"regex"`
+}
+
+// RouteCluster is a cluster a route sends traffic to. It is written either
+// as a plain cluster name or as a name and a weight. When a route has more
+// than one cluster, traffic is split between them in proportion to their
+// weights; either every cluster of the route has a weight or none do, in
+// which case traffic is split evenly.
+type RouteCluster struct {
+	Name   string  `yaml:"name"`
+	Weight *uint32 `yaml:"weight"`
 }
 
+// UnmarshalYAML accepts a RouteCluster written as a plain cluster name.
+func (c *RouteCluster) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&c.Name); err == nil {
+		return nil
+	}
+
+	type plain RouteCluster
+	return unmarshal((*plain)(c))
+}
+
+// Cluster is a group of upstream endpoints. Omitted settings default to a
+// 5s ConnectTimeout, the round_robin LbPolicy (least_request, random,
+// ring_hash and maglev are also supported), the v4_only DNSLookupFamily
+// (auto, v6_only, v4_preferred and all are also supported) and Envoy's
+// default per-connection buffer limit of 1MiB. LocalityWeighted balances
+// traffic across localities by their weight, the sum of the weights of
+// their endpoints, instead of Envoy's default zone aware routing.
+//
+// Type selects how Envoy discovers the cluster's endpoints: over eds from
+// this server (the default), or from endpoints embedded in the cluster that
+// are static IP addresses, or hostnames Envoy resolves itself with
+// strict_dns or logical_dns. DNS clusters re-resolve every DNSRefreshRate,
+// or at the TTL of the DNS records with RespectDNSTTL.
 type Cluster struct {
-	Name      string     `yaml:"name"`
-	Endpoints []Endpoint `yaml:"endpoints"`
+	Name                          string            `yaml:"name"`
+	Type                          string            `yaml:"type"`
+	Endpoints                     []Endpoint        `yaml:"endpoints"`
+	DNSRefreshRate                *time.Duration    `yaml:"dnsRefreshRate"`
+	RespectDNSTTL                 bool              `yaml:"respectDnsTtl"`
+	RetryBudget                   *RetryBudget      `yaml:"retryBudget"`
+	ConnectTimeout                *time.Duration    `yaml:"connectTimeout"`
+	LbPolicy                      string            `yaml:"lbPolicy"`
+	LeastRequest                  *LeastRequest     `yaml:"leastRequest"`
+	RingHash                      *RingHash         `yaml:"ringHash"`
+	Maglev                        *Maglev           `yaml:"maglev"`
+	DNSLookupFamily               string            `yaml:"dnsLookupFamily"`
+	PerConnectionBufferLimitBytes *uint32           `yaml:"perConnectionBufferLimitBytes"`
+	HealthChecks                  []HealthCheck     `yaml:"healthChecks"`
+	CircuitBreakers               []CircuitBreaker  `yaml:"circuitBreakers"`
+	OutlierDetection              *OutlierDetection `yaml:"outlierDetection"`
+	TLS                           *UpstreamTLS      `yaml:"tls"`
+	LocalityWeighted              bool              `yaml:"localityWeighted"`
+}
+
+// UpstreamTLS makes Envoy connect to a cluster's endpoints over TLS.
+// Certificates are never inlined: CASecret names the SDS secret holding
+// the CA bundle that upstream certificates are validated against, and
+// ClientCertificateSecret names the SDS secret holding the certificate and
+// key Envoy presents for mutual TLS. Without a CASecret the upstream
+// certificate is not validated.
+type UpstreamTLS struct {
+	SNI                     string                `yaml:"sni"`
+	CASecret                string                `yaml:"caSecret"`
+	SubjectAltNames         []SubjectAltNameMatch `yaml:"subjectAltNames"`
+	ClientCertificateSecret string                `yaml:"clientCertificateSecret"`
+	ALPN                    []string              `yaml:"alpn"`
+}
+
+// SubjectAltNameMatch requires the upstream certificate to have a subject
+// alternative name of Type (dns, uri, email or ip_address, dns by default)
+// that matches exactly one of Exact, Prefix, Suffix or Regex.
+type SubjectAltNameMatch struct {
+	Type   string `yaml:"type"`
+	Exact  string `yaml:"exact"`
+	Prefix string `yaml:"prefix"`
+	Suffix string `yaml:"suffix"`
+	Regex  string `yaml:"regex"`
+}
+
+// CircuitBreaker limits the connections and requests Envoy sends to a
+// cluster for requests of one routing priority, default or high. Limits
+// left out keep Envoy's default of 1024.
+type CircuitBreaker struct {
+	Priority           string  `yaml:"priority"`
+	MaxConnections     *uint32 `yaml:"maxConnections"`
+	MaxPendingRequests *uint32 `yaml:"maxPendingRequests"`
+	MaxRequests        *uint32 `yaml:"maxRequests"`
+	MaxRetries         *uint32 `yaml:"maxRetries"`
+}
+
+// OutlierDetection ejects endpoints from a cluster's load balancing pool
+// after consecutive 5xx responses, consecutive gateway failures (502, 503
+// and 504), or a success rate well below the rest of the cluster. An
+// ejected endpoint returns after BaseEjectionTime multiplied by the number
+// of times it has been ejected. Settings left out keep Envoy's defaults;
+// gateway failure ejection is only enabled when ConsecutiveGatewayFailure
+// is set.
+type OutlierDetection struct {
+	Consecutive5xx            *uint32              `yaml:"consecutive5xx"`
+	ConsecutiveGatewayFailure *uint32              `yaml:"consecutiveGatewayFailure"`
+	Interval                  *time.Duration       `yaml:"interval"`
+	BaseEjectionTime          *time.Duration       `yaml:"baseEjectionTime"`
+	MaxEjectionPercent        *uint32              `yaml:"maxEjectionPercent"`
+	SuccessRate               *SuccessRateEjection `yaml:"successRate"`
+}
+
+// SuccessRateEjection ejects endpoints whose success rate is more than
+// StdevFactor / 1000 standard deviations below the cluster's mean. It only
+// runs when at least MinimumHosts endpoints have each served RequestVolume
+// requests in the interval. EnforcingPercent is the chance an endpoint
+// found to be an outlier is actually ejected.
+type SuccessRateEjection struct {
+	MinimumHosts     *uint32 `yaml:"minimumHosts"`
+	RequestVolume    *uint32 `yaml:"requestVolume"`
+	StdevFactor      *uint32 `yaml:"stdevFactor"`
+	EnforcingPercent *uint32 `yaml:"enforcingPercent"`
+}
+
+// HealthCheck actively checks the health of a cluster's endpoints with an
+// http, tcp or grpc request. Omitted settings default to a 10s Interval, a
+// 2s Timeout, an UnhealthyThreshold of 3 and a HealthyThreshold of 2. HTTP
+// checks request Path and expect a 200 response unless ExpectedStatuses
+// says otherwise. TCP checks only connect. gRPC checks use the gRPC health
+// checking protocol for ServiceName.
+type HealthCheck struct {
+	Type               string         `yaml:"type"`
+	Path               string         `yaml:"path"`
+	Host               string         `yaml:"host"`
+	ExpectedStatuses   []StatusRange  `yaml:"expectedStatuses"`
+	ServiceName        string         `yaml:"serviceName"`
+	Interval           *time.Duration `yaml:"interval"`
+	Timeout            *time.Duration `yaml:"timeout"`
+	Jitter             *time.Duration `yaml:"jitter"`
+	HealthyThreshold   *uint32        `yaml:"healthyThreshold"`
+	UnhealthyThreshold *uint32        `yaml:"unhealthyThreshold"`
+}
+
+// StatusRange is an inclusive range of HTTP status codes, written either as
+// a single code (204) or as a range ("200-299").
+type StatusRange struct {
+	Start uint32
+	End   uint32
+}
+
+// UnmarshalYAML accepts a StatusRange written as a code or a range.
+func (r *StatusRange) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var code uint32
+	if err := unmarshal(&code); err == nil {
+		r.Start, r.End = code, code
+		return nil
+	}
+
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return fmt.Errorf("invalid status range %q, want a code or a range like 200-299", s)
+	}
+	first, err := strconv.ParseUint(start, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid status range %q, want a code or a range like 200-299", s)
+	}
+	last, err := strconv.ParseUint(end, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid status range %q, want a code or a range like 200-299", s)
+	}
+	r.Start, r.End = uint32(first), uint32(last)
+	return nil
+}
+
+// LeastRequest configures the least_request LbPolicy, which picks the
+// endpoint with the fewest active requests out of ChoiceCount random
+// choices (2 by default).
+type LeastRequest struct {
+	ChoiceCount *uint32 `yaml:"choiceCount"`
+}
+
+// RingHash configures the ring_hash LbPolicy.
+type RingHash struct {
+	MinimumRingSize *uint64 `yaml:"minimumRingSize"`
+	MaximumRingSize *uint64 `yaml:"maximumRingSize"`
+}
+
+// Maglev configures the maglev LbPolicy. TableSize must be a prime number.
+type Maglev struct {
+	TableSize *uint64 `yaml:"tableSize"`
+}
+
+// RetryBudget limits the retries active against a cluster to a percentage
+// of its active requests, but always allows at least MinRetryConcurrency.
+// It applies to requests of the default routing priority.
+type RetryBudget struct {
+	BudgetPercent       *float64 `yaml:"budgetPercent"`
+	MinRetryConcurrency *uint32  `yaml:"minRetryConcurrency"`
 }
 
+// Endpoint is an upstream host of a cluster. Endpoints are grouped by their
+// Region, Zone and SubZone locality and their Priority, 0 being the highest;
+// lower priorities only receive traffic when higher ones are unhealthy.
+// Weight is the endpoint's load balancing weight, 1 by default. Health
+// overrides the endpoint's health as healthy, draining, unhealthy or
+// degraded; draining endpoints get no new requests but finish those in
+// flight. Left out, Envoy works out the endpoint's health itself.
 type Endpoint struct {
-	Address string `yaml:"address"`
-	Port    uint32 `yaml:port"`
+	Address  string  `yaml:"address"`
+	Port     uint32  `yaml:"port"`
+	Region   string  `yaml:"region"`
+	Zone     string  `yaml:"zone"`
+	SubZone  string  `yaml:"subZone"`
+	Weight   *uint32 `yaml:"weight"`
+	Priority uint32  `yaml:"priority"`
+	Health   string  `yaml:"health"`
 }
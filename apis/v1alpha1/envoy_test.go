@@ -0,0 +1,81 @@
+//   Copyright Steve Sloka 2021
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package v1alpha1
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestStatusRangeUnmarshalYAML(t *testing.T) {
+	tests := map[string]struct {
+		yaml    string
+		want    StatusRange
+		wantErr bool
+	}{
+		"code":            {yaml: "200", want: StatusRange{Start: 200, End: 200}},
+		"range":           {yaml: `"200-299"`, want: StatusRange{Start: 200, End: 299}},
+		"trailing junk":   {yaml: `"200-299x"`, wantErr: true},
+		"leading junk":    {yaml: `"x200-299"`, wantErr: true},
+		"missing end":     {yaml: `"200-"`, wantErr: true},
+		"no separator":    {yaml: `"200x"`, wantErr: true},
+		"extra separator": {yaml: `"200-299-300"`, wantErr: true},
+		"negative":        {yaml: `"-200-299"`, wantErr: true},
+		"spaces":          {yaml: `"200 - 299"`, wantErr: true},
+		"mapping":         {yaml: "{start: 200}", wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got StatusRange
+			err := yaml.Unmarshal([]byte(tc.yaml), &got)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Unmarshal(%s) error = %v, wantErr %v", tc.yaml, err, tc.wantErr)
+			}
+			if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Unmarshal(%s) = %+v, want %+v", tc.yaml, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRouteClusterUnmarshalYAML(t *testing.T) {
+	weight := uint32(3)
+	tests := map[string]struct {
+		yaml    string
+		want    RouteCluster
+		wantErr bool
+	}{
+		"name":              {yaml: "api", want: RouteCluster{Name: "api"}},
+		"mapping":           {yaml: "{name: api, weight: 3}", want: RouteCluster{Name: "api", Weight: &weight}},
+		"mapping no weight": {yaml: "{name: api}", want: RouteCluster{Name: "api"}},
+		"sequence":          {yaml: "[api]", wantErr: true},
+		"invalid weight":    {yaml: "{name: api, weight: heavy}", wantErr: true},
+		"negative weight":   {yaml: "{name: api, weight: -1}", wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got RouteCluster
+			err := yaml.Unmarshal([]byte(tc.yaml), &got)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Unmarshal(%s) error = %v, wantErr %v", tc.yaml, err, tc.wantErr)
+			}
+			if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Unmarshal(%s) = %+v, want %+v", tc.yaml, got, tc.want)
+			}
+		})
+	}
+}
@@ -17,13 +17,17 @@ package main
 import (
 	"context"
 	"flag"
+	"strings"
 
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
 	log "github.com/sirupsen/logrus"
+	"github.com/stevesloka/envoy-xds-server/internal/metrics"
 	"github.com/stevesloka/envoy-xds-server/internal/processor"
+	"github.com/stevesloka/envoy-xds-server/internal/resources"
 	"github.com/stevesloka/envoy-xds-server/internal/server"
 	"github.com/stevesloka/envoy-xds-server/internal/watcher"
+	"github.com/stevesloka/envoy-xds-server/internal/xdscache"
 )
 
 var (
@@ -31,10 +35,18 @@ var (
 
 	watchDirectoryFileName string
 	port                   uint
+	adminPort              uint
 	basePort               uint
 	mode                   string
-
-	nodeID string
+	ads                    bool
+	delta                  bool
+	xdsCluster             string
+	xdsClusters            string
+
+	tlsCertFile       string
+	tlsKeyFile        string
+	tlsClientCAFile   string
+	requireClientCert bool
 )
 
 func init() {
@@ -44,48 +56,107 @@ func init() {
 	// The port that this xDS server listens on
 	flag.UintVar(&port, "port", 9002, "xDS management server port")
 
-	// Tell Envoy to use this Node ID
-	flag.StringVar(&nodeID, "nodeID", "test-id", "Node ID")
+	// The port that metrics are served on
+	flag.UintVar(&adminPort, "adminPort", 9004, "admin server port serving /metrics, 0 to disable")
+
+	// How listeners and clusters refer Envoy to the resources they use, for
+	// nodes whose metadata does not choose
+	flag.BoolVar(&ads, "ads", false, "make listeners and clusters fetch their routes, endpoints and secrets over ADS")
+	flag.BoolVar(&delta, "delta", false, "make listeners and clusters fetch their routes, endpoints and secrets over incremental (delta) xDS")
+	flag.StringVar(&xdsCluster, "xdsCluster", resources.DefaultXDSCluster, "name of the Envoy cluster that reaches this server, when not using ADS")
+	flag.StringVar(&xdsClusters, "xdsClusters", "", "comma separated names of other Envoy clusters nodes may choose through their xds_cluster metadata")
+
+	// Serve the xDS management server over TLS
+	flag.StringVar(&tlsCertFile, "tlsCert", "", "PEM certificate file to serve xDS over TLS with")
+	flag.StringVar(&tlsKeyFile, "tlsKey", "", "PEM private key file of -tlsCert")
+	flag.StringVar(&tlsClientCAFile, "tlsClientCA", "", "PEM CA bundle to validate Envoy client certificates with")
+	flag.BoolVar(&requireClientCert, "requireClientCert", false, "reject Envoys without a client certificate signed by -tlsClientCA")
 
 	// Define the directory to watch for Envoy configuration files
-	flag.StringVar(&watchDirectoryFileName, "watchDirectoryFileName", "config/config.yaml", "full path to directory to watch for files")
+	flag.StringVar(&watchDirectoryFileName, "watchDirectoryFileName", "config", "full path to a config file, or a directory of config files, to watch")
 }
 
 func main() {
 	flag.Parse()
 
-	// Create a cache
-	cache := cache.NewSnapshotCache(false, cache.IDHash{}, l)
+	var tlsFiles *server.TLSFiles
+	if tlsCertFile != "" || tlsKeyFile != "" {
+		if tlsCertFile == "" || tlsKeyFile == "" {
+			log.Fatal("-tlsCert and -tlsKey must be set together")
+		}
+		tlsFiles = &server.TLSFiles{
+			CertFile:          tlsCertFile,
+			KeyFile:           tlsKeyFile,
+			ClientCAFile:      tlsClientCAFile,
+			RequireClientCert: requireClientCert,
+		}
+	} else if tlsClientCAFile != "" || requireClientCert {
+		log.Fatal("-tlsClientCA and -requireClientCert need -tlsCert and -tlsKey")
+	}
+	if requireClientCert && tlsClientCAFile == "" {
+		log.Fatal("-requireClientCert needs -tlsClientCA")
+	}
+
+	// Create a cache, keyed by the snapshot group and config source each
+	// node is served
+	var allowedClusters []string
+	for _, name := range strings.Split(xdsClusters, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			allowedClusters = append(allowedClusters, name)
+		}
+	}
+	if xdsClusters != "" && len(allowedClusters) == 0 {
+		log.Fatalf("-xdsClusters %q names no clusters", xdsClusters)
+	}
+	nodeHash := xdscache.NewNodeHash(resources.ConfigSource{
+		ADS:         ads,
+		Delta:       delta,
+		ClusterName: xdsCluster,
+	}, allowedClusters)
+	cache := cache.NewSnapshotCache(ads, nodeHash, l)
 
 	// Create a processor
 	proc := processor.NewProcessor(
-		cache, nodeID, log.WithField("context", "processor"))
+		cache, nodeHash, log.WithField("context", "processor"))
 
-	// Create initial snapshot from file
-	proc.ProcessFile(watcher.NotifyMessage{
-		Operation: watcher.Create,
-		FilePath:  watchDirectoryFileName,
-	})
+	// Create initial snapshot from every config file
+	files, err := watcher.ConfigFiles(watchDirectoryFileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	proc.ProcessFiles(files)
 
 	// Notify channel for file system events
 	notifyCh := make(chan watcher.NotifyMessage)
 
-	go func() {
-		// Watch for file changes
-		watcher.Watch(watchDirectoryFileName, notifyCh)
-	}()
+	// Watch for changes to the config files, and the certificates they use
+	w, err := watcher.New(watchDirectoryFileName, notifyCh)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.WatchFiles(proc.ReferencedFiles())
+	go w.Run()
+
+	if adminPort != 0 {
+		// Serve metrics
+		go metrics.RunServer(adminPort)
+	}
 
 	go func() {
 		// Run the xDS server
 		ctx := context.Background()
-		srv := serverv3.NewServer(ctx, cache, nil)
-		server.RunServer(ctx, srv, port)
+		cb := server.NewCallbacks(log.WithField("context", "xds"), cache, nodeHash)
+		srv := serverv3.NewServer(ctx, cache, cb)
+		server.RunServer(ctx, srv, port, tlsFiles)
 	}()
 
 	for {
 		select {
 		case msg := <-notifyCh:
 			proc.ProcessFile(msg)
+			w.WatchFiles(proc.ReferencedFiles())
+		case <-nodeHash.Added():
+			proc.Rebuild()
 		}
 	}
 }
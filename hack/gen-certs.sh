@@ -0,0 +1,40 @@
+#!/usr/bin/env bash
+set -o errexit
+set -o nounset
+set -o pipefail
+
+# Generates a CA, a certificate for the xDS management server and a client
+# certificate for Envoy, for running the sample bootstrap over mutual TLS.
+# Keys are generated locally and never committed.
+
+CERTS=${CERTS:-hack/certs}
+DAYS=${DAYS:-365}
+
+mkdir -p "${CERTS}"
+cd "${CERTS}"
+
+# Certificate authority that signs both certificates
+openssl req -x509 -newkey rsa:2048 -nodes -days "${DAYS}" \
+  -subj "/CN=envoy-xds-server CA" \
+  -keyout ca.key -out ca.crt
+
+# sign NAME SUBJECT EXTENSIONS signs a certificate for NAME with the CA
+sign() {
+  openssl req -newkey rsa:2048 -nodes -subj "$2" \
+    -keyout "$1.key" -out "$1.csr"
+  openssl x509 -req -in "$1.csr" -days "${DAYS}" \
+    -CA ca.crt -CAkey ca.key -CAcreateserial \
+    -extfile <(printf "%s" "$3") -out "$1.crt"
+  rm "$1.csr"
+}
+
+# Server certificate, valid for the address in the sample bootstrap
+sign server "/CN=xds-server" \
+  "subjectAltName=DNS:localhost,IP:127.0.0.1
+extendedKeyUsage=serverAuth"
+
+# Client certificate that Envoy authenticates with
+sign envoy "/CN=envoy" \
+  "extendedKeyUsage=clientAuth"
+
+echo "certificates written to ${CERTS}"
@@ -6,5 +6,8 @@ set -o pipefail
 # Path to Envoy
 ENVOY=${ENVOY:-/usr/local/bin/envoy}
 
+# Bootstrap config to start Envoy with
+BOOTSTRAP=${BOOTSTRAP:-hack/bootstrap.yaml}
+
 ## Start Envoy with sample bootstrap config.
-${ENVOY} -c hack/bootstrap.yaml # --drain-time-s 1  # -l debug
+${ENVOY} -c ${BOOTSTRAP} # --drain-time-s 1  # -l debug
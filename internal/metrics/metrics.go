@@ -0,0 +1,103 @@
+//   Copyright Steve Sloka 2021
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+// Package metrics holds the Prometheus metrics of the control plane, and
+// serves them for scraping.
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "xds_server"
+
+var (
+	// ConfigParses counts config files loaded, by result: success or failure.
+	ConfigParses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_parses_total",
+		Help:      "Config files loaded, by result.",
+	}, []string{"result"})
+
+	// SnapshotPublishes counts snapshots set in the cache, by the node key
+	// they are served under.
+	SnapshotPublishes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "snapshot_publishes_total",
+		Help:      "Snapshots published, by the node key they are served under.",
+	}, []string{"node"})
+
+	// SnapshotVersion is the version of the last snapshots published.
+	SnapshotVersion = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "snapshot_version",
+		Help:      "Version of the last snapshots published.",
+	})
+
+	// Resources counts the resources of each type in the snapshot served
+	// under each node key.
+	Resources = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "resources",
+		Help:      "Resources in the snapshot served under each node key, by type.",
+	}, []string{"node", "type_url"})
+
+	// Streams counts the open xDS streams, by type URL. ADS streams carry
+	// every type, and are counted as ADS.
+	Streams = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "streams",
+		Help:      "Open xDS streams, by type URL.",
+	}, []string{"type_url"})
+
+	// ACKs counts the responses accepted by each Envoy node.
+	ACKs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "acks_total",
+		Help:      "Responses accepted, by Envoy node ID.",
+	}, []string{"node"})
+
+	// NACKs counts the responses rejected by each Envoy node.
+	NACKs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "nacks_total",
+		Help:      "Responses rejected, by Envoy node ID.",
+	}, []string{"node"})
+
+	// ChangeToSnapshot observes the time from a file changing to the
+	// snapshots built from it being published.
+	ChangeToSnapshot = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "change_to_snapshot_seconds",
+		Help:      "Time from a watched file changing to the snapshots built from it being published.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+	})
+)
+
+// RunServer serves the metrics at /metrics on the given port.
+func RunServer(port uint) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Printf("metrics server listening on %d\n", port)
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux); err != nil {
+		log.Println(err)
+	}
+}
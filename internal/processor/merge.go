@@ -0,0 +1,138 @@
+//   Copyright Steve Sloka 2021
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package processor
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/stevesloka/envoy-xds-server/apis/v1alpha1"
+	"github.com/stevesloka/envoy-xds-server/internal/xdscache"
+)
+
+// groupConfigs splits the loaded configs by the snapshot group they are
+// served to. Configs that select no nodes are part of every group, and the
+// default group always exists.
+func groupConfigs(configs map[string][]*v1alpha1.EnvoyConfig) map[string]map[string][]*v1alpha1.EnvoyConfig {
+	groups := map[string]map[string][]*v1alpha1.EnvoyConfig{
+		xdscache.DefaultNodeGroup: {},
+	}
+	for _, docs := range configs {
+		for _, config := range docs {
+			for _, group := range nodeGroups(config) {
+				groups[group] = make(map[string][]*v1alpha1.EnvoyConfig)
+			}
+		}
+	}
+
+	for file, docs := range configs {
+		for _, config := range docs {
+			selected := nodeGroups(config)
+			if len(selected) == 0 {
+				for group := range groups {
+					groups[group][file] = append(groups[group][file], config)
+				}
+				continue
+			}
+			for _, group := range selected {
+				groups[group][file] = append(groups[group][file], config)
+			}
+		}
+	}
+
+	return groups
+}
+
+// nodeGroups returns the snapshot groups selected by a config.
+func nodeGroups(config *v1alpha1.EnvoyConfig) []string {
+	var groups []string
+	seen := make(map[string]bool)
+	add := func(group string) {
+		if !seen[group] {
+			seen[group] = true
+			groups = append(groups, group)
+		}
+	}
+
+	for _, id := range config.Nodes.IDs {
+		add(xdscache.NodeIDGroup(id))
+	}
+	for _, cluster := range config.Nodes.Clusters {
+		add(xdscache.NodeClusterGroup(cluster))
+	}
+	return groups
+}
+
+// mergeConfigs combines the documents loaded from every file into a single
+// spec. Files are merged in path order so the result is deterministic.
+// A listener, cluster, secret or runtime layer name defined more than once is reported as a conflict.
+func mergeConfigs(configs map[string][]*v1alpha1.EnvoyConfig) (*v1alpha1.Spec, error) {
+	var files []string
+	for file := range configs {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	merged := &v1alpha1.Spec{}
+	listeners := make(map[string]string)
+	clusters := make(map[string]string)
+	secrets := make(map[string]string)
+	layers := make(map[string]string)
+
+	for _, file := range files {
+		for _, config := range configs[file] {
+			for _, l := range config.Listeners {
+				if other, ok := listeners[l.Name]; ok {
+					return nil, conflictError("listener", l.Name, other, file)
+				}
+				listeners[l.Name] = file
+				merged.Listeners = append(merged.Listeners, l)
+			}
+
+			for _, c := range config.Clusters {
+				if other, ok := clusters[c.Name]; ok {
+					return nil, conflictError("cluster", c.Name, other, file)
+				}
+				clusters[c.Name] = file
+				merged.Clusters = append(merged.Clusters, c)
+			}
+
+			for _, s := range config.Secrets {
+				if other, ok := secrets[s.Name]; ok {
+					return nil, conflictError("secret", s.Name, other, file)
+				}
+				secrets[s.Name] = file
+				merged.Secrets = append(merged.Secrets, s)
+			}
+
+			for _, l := range config.Runtime {
+				if other, ok := layers[l.Name]; ok {
+					return nil, conflictError("runtime layer", l.Name, other, file)
+				}
+				layers[l.Name] = file
+				merged.Runtime = append(merged.Runtime, l)
+			}
+		}
+	}
+
+	return merged, nil
+}
+
+func conflictError(kind, name, first, second string) error {
+	if first == second {
+		return fmt.Errorf("%s %q is defined more than once in %s", kind, name, first)
+	}
+	return fmt.Errorf("%s %q is defined in both %s and %s", kind, name, first, second)
+}
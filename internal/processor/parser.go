@@ -15,26 +15,107 @@
 package processor
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"path/filepath"
 
 	"github.com/stevesloka/envoy-xds-server/apis/v1alpha1"
 	"gopkg.in/yaml.v2"
 )
 
-// parseYaml takes in a yaml envoy config and returns a typed version
-func parseYaml(file string) (*v1alpha1.EnvoyConfig, error) {
-	var config v1alpha1.EnvoyConfig
-
+// parseYaml takes in a yaml envoy config file and returns a typed version
+// of every document it contains.
+func parseYaml(file string) ([]*v1alpha1.EnvoyConfig, error) {
 	yamlFile, err := ioutil.ReadFile(file)
 	if err != nil {
 		return nil, fmt.Errorf("Error reading YAML file: %s\n", err)
 	}
 
-	err = yaml.Unmarshal(yamlFile, &config)
-	if err != nil {
-		return nil, err
+	var configs []*v1alpha1.EnvoyConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(yamlFile))
+	for {
+		var config v1alpha1.EnvoyConfig
+		err := decoder.Decode(&config)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, &config)
+	}
+
+	// An empty file is most likely still being written. Loading it would
+	// withdraw everything the file served.
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("%s: no config documents in file", file)
+	}
+
+	return configs, nil
+}
+
+// readBodyFiles inlines the direct response bodies a config reads from
+// files, resolving relative paths against dir so the files can be watched.
+func readBodyFiles(config *v1alpha1.EnvoyConfig, dir string) error {
+	for _, l := range config.Listeners {
+		for _, vh := range listenerVirtualHosts(l) {
+			for _, r := range vh.Routes {
+				dr := r.DirectResponse
+				if dr == nil || dr.BodyFile == "" {
+					continue
+				}
+
+				dr.BodyFile = resolvePath(dir, dr.BodyFile)
+				body, err := ioutil.ReadFile(dr.BodyFile)
+				if err != nil {
+					return fmt.Errorf("route %q: error reading body file: %v", r.Name, err)
+				}
+				if len(body) > maxDirectResponseBodySize {
+					return fmt.Errorf("route %q: body file %s is %d bytes, more than the %d allowed", r.Name, dr.BodyFile, len(body), maxDirectResponseBodySize)
+				}
+				dr.Body = string(body)
+			}
+		}
 	}
 
-	return &config, nil
+	return nil
+}
+
+// bodyFiles returns the direct response body files a config reads.
+func bodyFiles(config *v1alpha1.EnvoyConfig) []string {
+	var files []string
+	for _, l := range config.Listeners {
+		for _, vh := range listenerVirtualHosts(l) {
+			for _, r := range vh.Routes {
+				if dr := r.DirectResponse; dr != nil && dr.BodyFile != "" {
+					files = append(files, filepath.Clean(dr.BodyFile))
+				}
+			}
+		}
+	}
+	return files
+}
+
+// resolveSecretPaths resolves the PEM file paths of a config's secrets
+// against dir, so they are read from the right place at snapshot time.
+func resolveSecretPaths(config *v1alpha1.EnvoyConfig, dir string) {
+	for i := range config.Secrets {
+		s := &config.Secrets[i]
+		for _, path := range []*string{&s.CertificateChain, &s.PrivateKey, &s.TrustedCA} {
+			if *path != "" {
+				*path = resolvePath(dir, *path)
+			}
+		}
+	}
+}
+
+// resolvePath resolves a path given in a config file against the
+// directory the file is in.
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
 }
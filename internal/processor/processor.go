@@ -15,46 +15,70 @@
 package processor
 
 import (
+	"context"
+	"fmt"
+	"hash/fnv"
 	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strconv"
+	"time"
 
+	"github.com/stevesloka/envoy-xds-server/apis/v1alpha1"
+	"github.com/stevesloka/envoy-xds-server/internal/metrics"
 	"github.com/stevesloka/envoy-xds-server/internal/resources"
 
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 
 	"github.com/stevesloka/envoy-xds-server/internal/xdscache"
 
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"github.com/sirupsen/logrus"
 	"github.com/stevesloka/envoy-xds-server/internal/watcher"
+	"google.golang.org/protobuf/proto"
 )
 
+// defaultVirtualHost names the virtual host that serves a listener's own
+// routes for every domain.
+const defaultVirtualHost = "local_service"
+
 type Processor struct {
-	cache  cache.SnapshotCache
-	nodeID string
+	cache    cache.SnapshotCache
+	nodeHash *xdscache.NodeHash
 
 	// snapshotVersion holds the current version of the snapshot.
 	snapshotVersion int64
 
 	logrus.FieldLogger
 
-	xdsCache xdscache.XDSCache
+	// configs holds the documents parsed from every loaded file, keyed by path.
+	configs map[string][]*v1alpha1.EnvoyConfig
+
+	// groups holds the snapshot groups published by the last update.
+	groups map[string]bool
+
+	// regroupVersion holds the snapshot version at which the groups last
+	// changed.
+	regroupVersion string
+
+	// snapshots holds the snapshot last published to each group, by
+	// snapshot key.
+	snapshots map[string]*cache.Snapshot
+
+	// expiries holds the expiry last logged for each certificate file.
+	expiries map[string]time.Time
 }
 
-func NewProcessor(cache cache.SnapshotCache, nodeID string, log logrus.FieldLogger) *Processor {
+func NewProcessor(cache cache.SnapshotCache, nodeHash *xdscache.NodeHash, log logrus.FieldLogger) *Processor {
 	return &Processor{
 		cache:           cache,
-		nodeID:          nodeID,
+		nodeHash:        nodeHash,
 		snapshotVersion: rand.Int63n(1000),
 		FieldLogger:     log,
-		xdsCache: xdscache.XDSCache{
-			Listeners: make(map[string]resources.Listener),
-			Clusters:  make(map[string]resources.Cluster),
-			Routes:    make(map[string]resources.Route),
-			Endpoints: make(map[string]resources.Endpoint),
-		},
+		configs:         make(map[string][]*v1alpha1.EnvoyConfig),
+		expiries:        make(map[string]time.Time),
 	}
 }
 
@@ -72,60 +96,713 @@ func (p *Processor) newSnapshotVersion() string {
 	return strconv.FormatInt(p.snapshotVersion, 10)
 }
 
+// ProcessFiles loads every given file and generates a single xDS snapshot
+// from their merged contents. A file that fails to load is skipped, so
+// that the others are still served.
+func (p *Processor) ProcessFiles(files []string) {
+	for _, file := range files {
+		if err := p.loadFile(file); err != nil {
+			p.Errorf("error loading config file, skipping it: %+v", err)
+		}
+	}
+
+	p.buildSnapshot()
+}
+
 // ProcessFile takes a file and generates an xDS snapshot
 func (p *Processor) ProcessFile(file watcher.NotifyMessage) {
 
-	// Parse file into object
-	envoyConfig, err := parseYaml(file.FilePath)
+	if !watcher.IsConfigFile(file.FilePath) {
+		// A certificate or key changed, its secrets are re-read, or a body
+		// file changed, and the config files using it are reloaded
+		p.Infof("referenced file %s changed", file.FilePath)
+		for _, config := range p.bodyFileUsers(file.FilePath) {
+			if err := p.loadFile(config); err != nil {
+				p.Errorf("error loading config file: %+v", err)
+				return
+			}
+		}
+	} else if _, err := os.Stat(file.FilePath); file.Operation == watcher.Remove && os.IsNotExist(err) {
+		// Withdraw everything the file contributed. A file still there was
+		// replaced, as editors do when saving, and is reloaded instead.
+		delete(p.configs, file.FilePath)
+	} else if err := p.loadFile(file.FilePath); err != nil {
+		// Parse file into object
+		p.Errorf("error loading config file: %+v", err)
+		return
+	}
+
+	p.buildSnapshot()
+	if !file.Time.IsZero() {
+		metrics.ChangeToSnapshot.Observe(time.Since(file.Time).Seconds())
+	}
+}
+
+// ReferencedFiles returns the files the loaded configs refer to: the
+// certificate and key files of their secrets, and their direct response
+// body files.
+func (p *Processor) ReferencedFiles() []string {
+	var files []string
+	for _, docs := range p.configs {
+		for _, config := range docs {
+			for _, s := range config.Secrets {
+				for _, path := range []string{s.CertificateChain, s.PrivateKey, s.TrustedCA} {
+					if path != "" {
+						files = append(files, path)
+					}
+				}
+			}
+			files = append(files, bodyFiles(config)...)
+		}
+	}
+	return files
+}
+
+// bodyFileUsers returns the config files with a direct response read from
+// the given body file.
+func (p *Processor) bodyFileUsers(path string) []string {
+	var users []string
+	for file, docs := range p.configs {
+		for _, config := range docs {
+			if containsString(bodyFiles(config), filepath.Clean(path)) {
+				users = append(users, file)
+				break
+			}
+		}
+	}
+	return users
+}
+
+// loadFile parses a file and records its documents, replacing any
+// previously loaded from the same path.
+func (p *Processor) loadFile(file string) (err error) {
+	defer func() {
+		if err != nil {
+			metrics.ConfigParses.WithLabelValues("failure").Inc()
+		} else {
+			metrics.ConfigParses.WithLabelValues("success").Inc()
+		}
+	}()
+
+	envoyConfigs, err := parseYaml(file)
 	if err != nil {
-		p.Errorf("error parsing yaml file: %+v", err)
+		return err
+	}
+
+	for _, config := range envoyConfigs {
+		if err := validateConfig(config); err != nil {
+			return fmt.Errorf("%s: config %q: %v", file, config.Name, err)
+		}
+		if err := readBodyFiles(config, filepath.Dir(file)); err != nil {
+			return fmt.Errorf("%s: config %q: %v", file, config.Name, err)
+		}
+		resolveSecretPaths(config, filepath.Dir(file))
+	}
+
+	p.configs[file] = envoyConfigs
+	return nil
+}
+
+// Rebuild publishes the snapshots again without reloading any file, so that
+// nodes which chose a config source not served before are sent one.
+func (p *Processor) Rebuild() {
+	p.buildSnapshot()
+}
+
+// buildSnapshot publishes a snapshot for every group of nodes selected by
+// the loaded configs, in every config source the nodes use.
+func (p *Processor) buildSnapshot() {
+	version := p.newSnapshotVersion()
+	configSources := p.nodeHash.ConfigSources()
+
+	// A group that fails to build keeps serving its previous snapshots. One
+	// that has none is not selected, so that its nodes stay where they are.
+	groups := make(map[string]bool)
+	xdsCaches := make(map[string]*xdscache.XDSCache)
+	for group, configs := range groupConfigs(p.configs) {
+		xdsCache, err := p.makeXDSCache(configs)
+		if err != nil {
+			p.Errorf("error building snapshot for %s: %+v", group, err)
+			if !p.groups[group] {
+				continue
+			}
+		}
+		groups[group] = true
+		xdsCaches[group] = xdsCache
+	}
+
+	// Adding or removing a group moves nodes between snapshot keys. A moved
+	// node's watch is left on its old key and only fires if a version there
+	// changes, so no version is kept when the groups change.
+	regrouped := len(groups) != len(p.groups)
+	for group := range groups {
+		if !p.groups[group] {
+			regrouped = true
+		}
+	}
+	if regrouped {
+		p.regroupVersion = version
+	}
+
+	snapshots := make(map[string]*cache.Snapshot)
+	for group, xdsCache := range xdsCaches {
+		if xdsCache == nil {
+			for source := range configSources {
+				key := xdscache.SnapshotKey(group, source)
+				snapshots[key] = p.snapshots[key]
+			}
+			continue
+		}
+
+		for source, configSource := range configSources {
+			key := xdscache.SnapshotKey(group, source)
+			xdsCache.ConfigSource = configSource
+
+			snapshot, err := makeSnapshot(keyVersion(version, key), xdsCache)
+			if err != nil {
+				p.Errorf("error building snapshot for %s: %+v", key, err)
+				snapshots[key] = p.snapshots[key]
+				continue
+			}
+			if !regrouped {
+				keepUnchangedVersions(p.snapshots[key], snapshot)
+			}
+			if err := saltResourceVersions(snapshot, keyVersion(p.regroupVersion, key)); err != nil {
+				p.Errorf("error building snapshot for %s: %+v", key, err)
+				snapshots[key] = p.snapshots[key]
+				continue
+			}
+			snapshots[key] = snapshot
+			p.Debugf("will serve snapshot to %s %+v", key, snapshot)
+
+			// Add the snapshot to the cache
+			if err := p.cache.SetSnapshot(context.Background(), key, snapshot); err != nil {
+				p.Errorf("snapshot error %q for %+v", err, snapshot)
+				os.Exit(1)
+			}
+			metrics.SnapshotPublishes.WithLabelValues(key).Inc()
+		}
+	}
+
+	var names []string
+	for group := range groups {
+		names = append(names, group)
+	}
+	p.nodeHash.SetGroups(names)
+
+	// Nodes still waiting on a group that is no longer selected are sent the
+	// snapshot of the group they now hash to, so that they are served the
+	// same resources before and after their next request moves them there.
+	for group := range p.groups {
+		if groups[group] {
+			continue
+		}
+		for source := range configSources {
+			key := xdscache.SnapshotKey(group, source)
+			fallback := snapshots[xdscache.SnapshotKey(xdscache.DefaultNodeGroup, source)]
+			if info := p.cache.GetStatusInfo(key); info != nil && info.GetNode() != nil {
+				if snapshot := snapshots[p.nodeHash.ID(info.GetNode())]; snapshot != nil {
+					fallback = snapshot
+				}
+			}
+			if fallback == nil {
+				continue
+			}
+			if err := p.cache.SetSnapshot(context.Background(), key, fallback); err != nil {
+				p.Errorf("snapshot error %q for %+v", err, fallback)
+				continue
+			}
+			metrics.SnapshotPublishes.WithLabelValues(key).Inc()
+		}
+	}
+	p.groups = groups
+	p.snapshots = snapshots
+
+	metrics.SnapshotVersion.Set(float64(p.snapshotVersion))
+	recordResources(snapshots)
+}
+
+// keyVersion returns the version of the snapshot published under a key.
+// The key is mixed in so that no two keys share a version: a node that is
+// re-hashed to another key then always holds a version that key differs
+// from, and is sent the key's resources.
+func keyVersion(version, key string) string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("%s-%08x", version, h.Sum32())
+}
+
+// saltResourceVersions appends salt to the version of every resource, which
+// delta xDS compares resources by. Delta clients are only sent resources
+// whose version differs from the one they hold, so salting with the key and
+// the version of the last regrouping sends a moved node the resources of its
+// new key, and makes the watches left on its old key fire.
+func saltResourceVersions(snapshot *cache.Snapshot, salt string) error {
+	if err := snapshot.ConstructVersionMap(); err != nil {
+		return err
+	}
+	for _, versions := range snapshot.VersionMap {
+		for name, version := range versions {
+			versions[name] = version + "-" + salt
+		}
+	}
+	return nil
+}
+
+// recordResources records the number of resources of each type served
+// under each node key.
+func recordResources(snapshots map[string]*cache.Snapshot) {
+	metrics.Resources.Reset()
+	for key, snapshot := range snapshots {
+		if snapshot == nil {
+			continue
+		}
+		for i, r := range snapshot.Resources {
+			typeURL, err := cache.GetResponseTypeURL(types.ResponseType(i))
+			if err != nil {
+				continue
+			}
+			metrics.Resources.WithLabelValues(key, typeURL).Set(float64(len(r.Items)))
+		}
+	}
+}
+
+// keepUnchangedVersions gives every resource type whose resources are the
+// same as in the previous snapshot its previous version, so that Envoy is
+// only sent the types that changed. A rotated certificate then only pushes
+// the secrets, leaving listeners and clusters alone.
+func keepUnchangedVersions(previous, snapshot *cache.Snapshot) {
+	if previous == nil {
 		return
 	}
 
+	for i := range snapshot.Resources {
+		if sameResources(previous.Resources[i].Items, snapshot.Resources[i].Items) {
+			snapshot.Resources[i].Version = previous.Resources[i].Version
+		}
+	}
+}
+
+func sameResources(a, b map[string]types.ResourceWithTTL) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, r := range a {
+		other, ok := b[name]
+		if !ok || !proto.Equal(r.Resource, other.Resource) {
+			return false
+		}
+	}
+	return true
+}
+
+// makeXDSCache merges a group's configs into the resources to serve it.
+// The desired state is rebuilt from scratch every time so that anything no
+// longer present in the config files is dropped from the snapshot.
+func (p *Processor) makeXDSCache(configs map[string][]*v1alpha1.EnvoyConfig) (*xdscache.XDSCache, error) {
+	envoyConfig, err := mergeConfigs(configs)
+	if err != nil {
+		return nil, err
+	}
+
+	xdsCache := &xdscache.XDSCache{
+		Listeners:    make(map[string]resources.Listener),
+		Clusters:     make(map[string]resources.Cluster),
+		RouteConfigs: make(map[string]resources.RouteConfig),
+		Endpoints:    make(map[string]resources.Endpoint),
+		Secrets:      make(map[string]resources.Secret),
+		Runtimes:     make(map[string]resources.RuntimeLayer),
+	}
+
+	if err := checkSecretRefs(envoyConfig); err != nil {
+		return nil, err
+	}
+
+	// Parse Secrets
+	for _, s := range envoyConfig.Secrets {
+		secret, err := loadSecret(s)
+		if err != nil {
+			return nil, fmt.Errorf("secret %q: %v", s.Name, err)
+		}
+		if s.TrustedCA != "" {
+			p.logExpiry(s.TrustedCA, secret.TrustedCA)
+		} else {
+			p.logExpiry(s.CertificateChain, secret.CertificateChain)
+		}
+		xdsCache.AddSecret(secret)
+	}
+
+	// Parse Runtime layers
+	for _, l := range envoyConfig.Runtime {
+		layer := resources.RuntimeLayer{
+			Name:               l.Name,
+			Values:             make(map[string]interface{}),
+			FractionalPercents: make(map[string]resources.FractionalPercent),
+		}
+		for key, value := range l.Values {
+			layer.Values[key], _ = runtimeValue(value)
+		}
+		for key, fp := range l.FractionalPercents {
+			layer.FractionalPercents[key] = resources.FractionalPercent{
+				Numerator:   fp.Numerator,
+				Denominator: fp.Denominator,
+			}
+		}
+		xdsCache.AddRuntimeLayer(layer)
+	}
+
 	// Parse Listeners
 	for _, l := range envoyConfig.Listeners {
-		var lRoutes []string
-		for _, lr := range l.Routes {
-			lRoutes = append(lRoutes, lr.Name)
+		listener := resources.Listener{
+			Name:        l.Name,
+			Address:     l.Address,
+			Port:        l.Port,
+			Protocol:    l.Protocol,
+			Clusters:    makeWeightedClusters(l.Clusters),
+			IdleTimeout: l.IdleTimeout,
+			AccessLog:   l.AccessLog,
+		}
+		if t := l.TLS; t != nil {
+			listener.TLS = &resources.DownstreamTLS{
+				CertificateSecrets:       t.CertificateSecrets,
+				ClientCASecret:           t.ClientCASecret,
+				RequireClientCertificate: t.RequireClientCertificate,
+				MinVersion:               t.MinVersion,
+				MaxVersion:               t.MaxVersion,
+				CipherSuites:             t.CipherSuites,
+				ALPN:                     t.ALPN,
+			}
 		}
+		xdsCache.AddListener(listener)
+
+		for _, vh := range listenerVirtualHosts(l) {
+			xdsCache.AddVirtualHost(l.Name, resources.VirtualHost{
+				Name:        vh.Name,
+				Domains:     vh.Domains,
+				RetryPolicy: makeRetryPolicy(vh.RetryPolicy),
+			})
 
-		p.xdsCache.AddListener(l.Name, lRoutes, l.Address, l.Port)
+			for _, r := range vh.Routes {
+				route := makeRoute(r)
 
-		for _, r := range l.Routes {
-			p.xdsCache.AddRoute(r.Name, r.Prefix, r.ClusterNames)
+				// Routes inherit the timeouts of their virtual host
+				if route.Timeout == nil {
+					route.Timeout = vh.Timeout
+				}
+				if route.IdleTimeout == nil {
+					route.IdleTimeout = vh.IdleTimeout
+				}
+
+				xdsCache.AddRoute(l.Name, vh.Name, route)
+			}
 		}
 	}
 
 	// Parse Clusters
 	for _, c := range envoyConfig.Clusters {
-		p.xdsCache.AddCluster(c.Name)
+		cluster := resources.Cluster{
+			Name:                          c.Name,
+			Type:                          c.Type,
+			DNSRefreshRate:                c.DNSRefreshRate,
+			RespectDNSTTL:                 c.RespectDNSTTL,
+			LbPolicy:                      c.LbPolicy,
+			DNSLookupFamily:               c.DNSLookupFamily,
+			PerConnectionBufferLimitBytes: c.PerConnectionBufferLimitBytes,
+			LocalityWeighted:              c.LocalityWeighted,
+		}
+		if c.ConnectTimeout != nil {
+			cluster.ConnectTimeout = *c.ConnectTimeout
+		}
+		if c.LeastRequest != nil {
+			cluster.LeastRequestChoiceCount = c.LeastRequest.ChoiceCount
+		}
+		if c.RingHash != nil {
+			cluster.RingHashMinimumSize = c.RingHash.MinimumRingSize
+			cluster.RingHashMaximumSize = c.RingHash.MaximumRingSize
+		}
+		if c.Maglev != nil {
+			cluster.MaglevTableSize = c.Maglev.TableSize
+		}
+		for _, hc := range c.HealthChecks {
+			cluster.HealthChecks = append(cluster.HealthChecks, makeHealthCheck(hc))
+		}
+		for _, cb := range c.CircuitBreakers {
+			cluster.CircuitBreakers = append(cluster.CircuitBreakers, resources.CircuitBreaker{
+				Priority:           cb.Priority,
+				MaxConnections:     cb.MaxConnections,
+				MaxPendingRequests: cb.MaxPendingRequests,
+				MaxRequests:        cb.MaxRequests,
+				MaxRetries:         cb.MaxRetries,
+			})
+		}
+		if t := c.TLS; t != nil {
+			cluster.TLS = &resources.UpstreamTLS{
+				SNI:                     t.SNI,
+				CASecret:                t.CASecret,
+				ClientCertificateSecret: t.ClientCertificateSecret,
+				ALPN:                    t.ALPN,
+			}
+			for _, san := range t.SubjectAltNames {
+				cluster.TLS.SubjectAltNames = append(cluster.TLS.SubjectAltNames, resources.SubjectAltNameMatch{
+					Type:   san.Type,
+					Exact:  san.Exact,
+					Prefix: san.Prefix,
+					Suffix: san.Suffix,
+					Regex:  san.Regex,
+				})
+			}
+		}
+		if od := c.OutlierDetection; od != nil {
+			cluster.OutlierDetection = &resources.OutlierDetection{
+				Consecutive5xx:            od.Consecutive5xx,
+				ConsecutiveGatewayFailure: od.ConsecutiveGatewayFailure,
+				Interval:                  od.Interval,
+				BaseEjectionTime:          od.BaseEjectionTime,
+				MaxEjectionPercent:        od.MaxEjectionPercent,
+			}
+			if sr := od.SuccessRate; sr != nil {
+				cluster.OutlierDetection.SuccessRateMinimumHosts = sr.MinimumHosts
+				cluster.OutlierDetection.SuccessRateRequestVolume = sr.RequestVolume
+				cluster.OutlierDetection.SuccessRateStdevFactor = sr.StdevFactor
+				cluster.OutlierDetection.EnforcingSuccessRatePercent = sr.EnforcingPercent
+			}
+		}
+		if c.RetryBudget != nil {
+			cluster.RetryBudget = &resources.RetryBudget{
+				BudgetPercent:       c.RetryBudget.BudgetPercent,
+				MinRetryConcurrency: c.RetryBudget.MinRetryConcurrency,
+			}
+		}
+		xdsCache.AddCluster(cluster)
 
 		// Parse endpoints
 		for _, e := range c.Endpoints {
-			p.xdsCache.AddEndpoint(c.Name, e.Address, e.Port)
+			xdsCache.AddEndpoint(c.Name, resources.Endpoint{
+				UpstreamHost: e.Address,
+				UpstreamPort: e.Port,
+				Region:       e.Region,
+				Zone:         e.Zone,
+				SubZone:      e.SubZone,
+				Weight:       e.Weight,
+				Priority:     e.Priority,
+				Health:       e.Health,
+			})
 		}
 	}
 
-	// Create the snapshot that we'll serve to Envoy
-	snapshot := cache.NewSnapshot(
-		p.newSnapshotVersion(),         // version
-		p.xdsCache.EndpointsContents(), // endpoints
-		p.xdsCache.ClusterContents(),   // clusters
-		p.xdsCache.RouteContents(),     // routes
-		p.xdsCache.ListenerContents(),  // listeners
-		[]types.Resource{},             // runtimes
-		[]types.Resource{},             // secrets
-	)
+	return xdsCache, nil
+}
+
+// makeSnapshot creates the snapshot that we'll serve to Envoy from the
+// resources in xdsCache.
+func makeSnapshot(version string, xdsCache *xdscache.XDSCache) (*cache.Snapshot, error) {
+	snapshot, err := cache.NewSnapshot(version, map[resource.Type][]types.Resource{
+		resource.EndpointType: xdsCache.EndpointsContents(),
+		resource.ClusterType:  xdsCache.ClusterContents(),
+		resource.RouteType:    xdsCache.RouteContents(),
+		resource.ListenerType: xdsCache.ListenerContents(),
+		resource.RuntimeType:  xdsCache.RuntimeContents(),
+		resource.SecretType:   xdsCache.SecretContents(),
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	if err := snapshot.Consistent(); err != nil {
-		p.Errorf("snapshot inconsistency: %+v\n\n\n%+v", snapshot, err)
-		return
+		return nil, fmt.Errorf("snapshot inconsistency: %+v\n\n\n%+v", snapshot, err)
+	}
+
+	return snapshot, nil
+}
+
+// listenerVirtualHosts returns the virtual hosts of a listener, including
+// the catch-all virtual host that serves the listener's own routes.
+func listenerVirtualHosts(l v1alpha1.Listener) []v1alpha1.VirtualHost {
+	var vhosts []v1alpha1.VirtualHost
+	if len(l.Routes) > 0 {
+		vhosts = append(vhosts, v1alpha1.VirtualHost{
+			Name:    defaultVirtualHost,
+			Domains: []string{"*"},
+			Routes:  l.Routes,
+		})
+	}
+	return append(vhosts, l.VirtualHosts...)
+}
+
+// makeRoute converts a route, along with the action it takes on the
+// requests it matches.
+func makeRoute(r v1alpha1.Route) resources.Route {
+	route := resources.Route{
+		Name:     r.Name,
+		Match:    makeRouteMatch(r),
+		Clusters: makeWeightedClusters(r.Clusters),
+		Rewrite: resources.Rewrite{
+			Prefix: r.PrefixRewrite,
+			Host:   r.HostRewrite,
+		},
+		Timeout:     r.Timeout,
+		IdleTimeout: r.IdleTimeout,
+		RetryPolicy: makeRetryPolicy(r.RetryPolicy),
+	}
+
+	if r.RegexRewrite != nil {
+		route.Rewrite.RegexPattern = r.RegexRewrite.Pattern
+		route.Rewrite.RegexSubstitution = r.RegexRewrite.Substitution
+	}
+
+	if rd := r.Redirect; rd != nil {
+		route.Redirect = &resources.Redirect{
+			Scheme:        rd.Scheme,
+			Host:          rd.Host,
+			Port:          rd.Port,
+			Path:          rd.Path,
+			PrefixRewrite: rd.PrefixRewrite,
+			ResponseCode:  rd.ResponseCode,
+			StripQuery:    rd.StripQuery,
+		}
 	}
-	p.Debugf("will serve snapshot %+v", snapshot)
 
-	// Add the snapshot to the cache
-	if err := p.cache.SetSnapshot(p.nodeID, snapshot); err != nil {
-		p.Errorf("snapshot error %q for %+v", err, snapshot)
-		os.Exit(1)
+	if dr := r.DirectResponse; dr != nil {
+		route.DirectResponse = &resources.DirectResponse{
+			Status: dr.Status,
+			Body:   dr.Body,
+		}
+	}
+
+	return route
+}
+
+// makeHealthCheck converts a cluster health check. Settings left out are
+// zero, for the resources package to default.
+func makeHealthCheck(hc v1alpha1.HealthCheck) resources.HealthCheck {
+	check := resources.HealthCheck{
+		Type:        hc.Type,
+		Path:        hc.Path,
+		Host:        hc.Host,
+		ServiceName: hc.ServiceName,
+	}
+
+	for _, r := range hc.ExpectedStatuses {
+		check.ExpectedStatuses = append(check.ExpectedStatuses, resources.StatusRange{
+			Start: r.Start,
+			End:   r.End,
+		})
+	}
+
+	if hc.Interval != nil {
+		check.Interval = *hc.Interval
+	}
+	if hc.Timeout != nil {
+		check.Timeout = *hc.Timeout
+	}
+	if hc.Jitter != nil {
+		check.Jitter = *hc.Jitter
+	}
+	if hc.HealthyThreshold != nil {
+		check.HealthyThreshold = *hc.HealthyThreshold
+	}
+	if hc.UnhealthyThreshold != nil {
+		check.UnhealthyThreshold = *hc.UnhealthyThreshold
+	}
+
+	return check
+}
+
+// makeRetryPolicy converts a retry policy. Retriable status codes are only
+// retried with the retriable-status-codes condition, so it is added for them.
+func makeRetryPolicy(rp *v1alpha1.RetryPolicy) *resources.RetryPolicy {
+	if rp == nil {
+		return nil
+	}
+
+	policy := &resources.RetryPolicy{
+		RetryOn:              rp.RetryOn,
+		NumRetries:           rp.NumRetries,
+		PerTryTimeout:        rp.PerTryTimeout,
+		RetriableStatusCodes: rp.RetriableStatusCodes,
+	}
+
+	if len(rp.RetriableStatusCodes) > 0 && !containsString(rp.RetryOn, "retriable-status-codes") {
+		policy.RetryOn = append(append([]string{}, rp.RetryOn...), "retriable-status-codes")
+	}
+
+	if rp.BackOff != nil {
+		policy.BaseInterval = rp.BackOff.BaseInterval
+		policy.MaxInterval = rp.BackOff.MaxInterval
+	}
+
+	return policy
+}
+
+// runtimeValue converts a runtime value parsed from YAML to the bool,
+// float64 or string it is served as, reporting whether it is one of them.
+func runtimeValue(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case bool, float64, string:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return nil, false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// makeRouteMatch converts the conditions a route matches requests on.
+func makeRouteMatch(r v1alpha1.Route) resources.RouteMatch {
+	match := resources.RouteMatch{
+		Prefix:              r.Prefix,
+		Path:                r.Path,
+		Regex:               r.Regex,
+		PathSeparatedPrefix: r.PathSeparatedPrefix,
+		CaseSensitive:       r.CaseSensitive,
+		Methods:             r.Methods,
+	}
+
+	for _, h := range r.Headers {
+		match.Headers = append(match.Headers, resources.HeaderMatch{
+			Name:   h.Name,
+			Exact:  h.Exact,
+			Regex:  h.Regex,
+			Invert: h.Invert,
+		})
+	}
+
+	for _, q := range r.QueryParams {
+		match.QueryParams = append(match.QueryParams, resources.QueryParamMatch{
+			Name:  q.Name,
+			Exact: q.Exact,
+			Regex: q.Regex,
+		})
+	}
+
+	return match
+}
+
+// makeWeightedClusters converts the clusters of a route. Clusters without a
+// weight share the route's traffic evenly.
+func makeWeightedClusters(clusters []v1alpha1.RouteCluster) []resources.WeightedCluster {
+	var wc []resources.WeightedCluster
+	for _, c := range clusters {
+		weight := uint32(1)
+		if c.Weight != nil {
+			weight = *c.Weight
+		}
+		wc = append(wc, resources.WeightedCluster{
+			Name:   c.Name,
+			Weight: weight,
+		})
 	}
+	return wc
 }
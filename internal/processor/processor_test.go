@@ -0,0 +1,503 @@
+//   Copyright Steve Sloka 2021
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package processor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/stevesloka/envoy-xds-server/apis/v1alpha1"
+	"github.com/stevesloka/envoy-xds-server/internal/resources"
+	"github.com/stevesloka/envoy-xds-server/internal/watcher"
+	"github.com/stevesloka/envoy-xds-server/internal/xdscache"
+)
+
+func TestGroupConfigs(t *testing.T) {
+	shared := &v1alpha1.EnvoyConfig{Name: "shared"}
+	edge := &v1alpha1.EnvoyConfig{Name: "edge"}
+	edge.Nodes.IDs = []string{"x"}
+	edge.Nodes.Clusters = []string{"edge"}
+
+	groups := groupConfigs(map[string][]*v1alpha1.EnvoyConfig{
+		"a.yaml": {shared},
+		"b.yaml": {edge},
+	})
+
+	want := map[string][]string{
+		xdscache.DefaultNodeGroup:         {"shared"},
+		xdscache.NodeIDGroup("x"):         {"edge", "shared"},
+		xdscache.NodeClusterGroup("edge"): {"edge", "shared"},
+	}
+	got := make(map[string][]string)
+	for group, configs := range groups {
+		got[group] = []string{}
+		for _, docs := range configs {
+			for _, config := range docs {
+				got[group] = append(got[group], config.Name)
+			}
+		}
+		sort.Strings(got[group])
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("groupConfigs() = %v, want %v", got, want)
+	}
+}
+
+func TestMergeConfigs(t *testing.T) {
+	a := &v1alpha1.EnvoyConfig{}
+	a.Listeners = []v1alpha1.Listener{{Name: "l1"}}
+	b := &v1alpha1.EnvoyConfig{}
+	b.Listeners = []v1alpha1.Listener{{Name: "l2"}}
+
+	spec, err := mergeConfigs(map[string][]*v1alpha1.EnvoyConfig{
+		"b.yaml": {b},
+		"a.yaml": {a},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, l := range spec.Listeners {
+		names = append(names, l.Name)
+	}
+	if want := []string{"l1", "l2"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("merged listeners = %v, want %v", names, want)
+	}
+
+	_, err = mergeConfigs(map[string][]*v1alpha1.EnvoyConfig{
+		"a.yaml": {a},
+		"c.yaml": {a},
+	})
+	if err == nil || !strings.Contains(err.Error(), "a.yaml and c.yaml") {
+		t.Errorf("mergeConfigs() error = %v, want a conflict between a.yaml and c.yaml", err)
+	}
+}
+
+// A file that fails to load does not keep the other files from being served.
+func TestProcessFilesSkipsBadFile(t *testing.T) {
+	dir := t.TempDir()
+	a := writeConfig(t, dir, "a.yaml", "name: [broken")
+	b := writeConfig(t, dir, "b.yaml", listenerConfig("l2", 10002))
+
+	c, p := newTestProcessor()
+	p.ProcessFiles([]string{a, b})
+
+	_, names := receive(t, watchListeners(c, &core.Node{Id: "x"}, ""))
+	if want := []string{"l2"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("listeners = %v, want %v", names, want)
+	}
+}
+
+// An empty file, such as one still being written, keeps the file's last
+// good config being served.
+func TestEmptyFileKeepsLastConfig(t *testing.T) {
+	dir := t.TempDir()
+	a := writeConfig(t, dir, "a.yaml", listenerConfig("l1", 10001))
+
+	c, p := newTestProcessor()
+	p.ProcessFiles([]string{a})
+
+	node := &core.Node{Id: "x"}
+	version, _ := receive(t, watchListeners(c, node, ""))
+
+	for _, config := range []string{"", "# comment only\n", "name: [broken"} {
+		writeConfig(t, dir, "a.yaml", config)
+		p.ProcessFile(watcher.NotifyMessage{Operation: watcher.Modify, FilePath: a})
+	}
+
+	select {
+	case resp := <-watchListeners(c, node, version):
+		t.Fatalf("listeners were withdrawn: %+v", resp)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// A file renamed over, as editors save files, is reloaded rather than
+// withdrawn.
+func TestReplacedFileIsNotWithdrawn(t *testing.T) {
+	dir := t.TempDir()
+	a := writeConfig(t, dir, "a.yaml", listenerConfig("l1", 10001))
+
+	c, p := newTestProcessor()
+	p.ProcessFiles([]string{a})
+
+	node := &core.Node{Id: "x"}
+	version, _ := receive(t, watchListeners(c, node, ""))
+
+	tmp := writeConfig(t, dir, ".a.yaml.swp", listenerConfig("l2", 10002))
+	if err := os.Rename(tmp, a); err != nil {
+		t.Fatal(err)
+	}
+	p.ProcessFile(watcher.NotifyMessage{Operation: watcher.Remove, FilePath: a})
+
+	_, names := receive(t, watchListeners(c, node, version))
+	if want := []string{"l2"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("listeners after replacing a.yaml = %v, want %v", names, want)
+	}
+}
+
+// A changed body file is read again, and one larger than Envoy accepts is
+// rejected.
+func TestBodyFileChange(t *testing.T) {
+	dir := t.TempDir()
+	body := writeConfig(t, dir, "body.html", "down")
+	a := writeConfig(t, dir, "a.yaml", `name: a
+spec:
+  listeners:
+  - name: l1
+    address: 0.0.0.0
+    port: 10001
+    routes:
+    - name: maintenance
+      prefix: /
+      directResponse:
+        status: 503
+        bodyFile: body.html
+`)
+
+	c, p := newTestProcessor()
+	p.ProcessFiles([]string{a})
+	if files := p.ReferencedFiles(); !reflect.DeepEqual(files, []string{body}) {
+		t.Fatalf("ReferencedFiles() = %v, want %v", files, []string{body})
+	}
+
+	node := &core.Node{Id: "x"}
+	version, got := receiveBody(t, watchRoutes(c, node, ""))
+	if got != "down" {
+		t.Fatalf("body = %q, want %q", got, "down")
+	}
+
+	writeConfig(t, dir, "body.html", "back soon")
+	p.ProcessFile(watcher.NotifyMessage{Operation: watcher.Modify, FilePath: body})
+	version, got = receiveBody(t, watchRoutes(c, node, version))
+	if got != "back soon" {
+		t.Fatalf("body after change = %q, want %q", got, "back soon")
+	}
+
+	writeConfig(t, dir, "body.html", strings.Repeat("x", maxDirectResponseBodySize+1))
+	p.ProcessFile(watcher.NotifyMessage{Operation: watcher.Modify, FilePath: body})
+	select {
+	case resp := <-watchRoutes(c, node, version):
+		t.Fatalf("too large body was served: %+v", resp)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// A node whose group is withdrawn is re-hashed to the default group, and
+// must be sent its resources even though it acknowledged a version of its
+// old group.
+func TestRemovedGroupRehashesNode(t *testing.T) {
+	dir := t.TempDir()
+	a := writeConfig(t, dir, "a.yaml", listenerConfig("l1", 10001))
+	b := writeConfig(t, dir, "b.yaml", listenerConfig("l2", 10002, "x"))
+
+	c, p := newTestProcessor()
+	p.ProcessFiles([]string{a, b})
+
+	node := &core.Node{Id: "x"}
+	version, names := receive(t, watchListeners(c, node, ""))
+	if want := []string{"l1", "l2"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("listeners = %v, want %v", names, want)
+	}
+
+	ch := watchListeners(c, node, version)
+	if err := os.Remove(b); err != nil {
+		t.Fatal(err)
+	}
+	p.ProcessFile(watcher.NotifyMessage{Operation: watcher.Remove, FilePath: b})
+
+	version, names = receive(t, ch)
+	if want := []string{"l1"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("listeners after removing b.yaml = %v, want %v", names, want)
+	}
+	if key := p.nodeHash.ID(node); key != xdscache.DefaultNodeGroup {
+		t.Errorf("node is hashed to %q, want %q", key, xdscache.DefaultNodeGroup)
+	}
+}
+
+// A node whose ID group is removed while its cluster is still selected is
+// sent the resources of the cluster group, not only the default ones.
+func TestRemovedGroupFallsBackToClusterGroup(t *testing.T) {
+	dir := t.TempDir()
+	a := writeConfig(t, dir, "a.yaml", listenerConfig("l1", 10001))
+	b := writeConfig(t, dir, "b.yaml", listenerConfig("l2", 10002, "x"))
+	edge := strings.Replace(listenerConfig("l3", 10003, "edge"), "ids:", "clusters:", 1)
+	e := writeConfig(t, dir, "e.yaml", edge)
+
+	c, p := newTestProcessor()
+	p.ProcessFiles([]string{a, b, e})
+
+	node := &core.Node{Id: "x", Cluster: "edge"}
+	version, names := receive(t, watchListeners(c, node, ""))
+	if want := []string{"l1", "l2"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("listeners = %v, want %v", names, want)
+	}
+
+	ch := watchListeners(c, node, version)
+	if err := os.Remove(b); err != nil {
+		t.Fatal(err)
+	}
+	p.ProcessFile(watcher.NotifyMessage{Operation: watcher.Remove, FilePath: b})
+
+	_, names = receive(t, ch)
+	if want := []string{"l1", "l3"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("listeners after removing b.yaml = %v, want %v", names, want)
+	}
+	if key, want := p.nodeHash.ID(node), "cluster/edge"; key != want {
+		t.Errorf("node is hashed to %q, want %q", key, want)
+	}
+}
+
+// A node selected by a new config is re-hashed from the default group to
+// its own, and must be sent its resources even though the default group's
+// resources did not change.
+func TestAddedGroupRehashesNode(t *testing.T) {
+	dir := t.TempDir()
+	a := writeConfig(t, dir, "a.yaml", listenerConfig("l1", 10001))
+
+	c, p := newTestProcessor()
+	p.ProcessFiles([]string{a})
+
+	node := &core.Node{Id: "x"}
+	version, _ := receive(t, watchListeners(c, node, ""))
+
+	ch := watchListeners(c, node, version)
+	b := writeConfig(t, dir, "b.yaml", listenerConfig("l2", 10002, "x"))
+	p.ProcessFile(watcher.NotifyMessage{Operation: watcher.Create, FilePath: b})
+
+	// The watch left on the default group fires, and the node's next
+	// request is hashed to its own group
+	version, _ = receive(t, ch)
+	version, names := receive(t, watchListeners(c, node, version))
+	if want := []string{"l1", "l2"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("listeners after adding b.yaml = %v, want %v", names, want)
+	}
+}
+
+// Delta clients are moved the same way: the delta watch left on the default
+// group fires, and the node's next request is sent its own group's resources.
+func TestAddedGroupRehashesDeltaNode(t *testing.T) {
+	dir := t.TempDir()
+	a := writeConfig(t, dir, "a.yaml", listenerConfig("l1", 10001))
+
+	c, p := newTestProcessor()
+	p.ProcessFiles([]string{a})
+
+	node := &core.Node{Id: "x"}
+	versions, _ := receiveDelta(t, watchDeltaListeners(c, node, nil))
+
+	ch := watchDeltaListeners(c, node, versions)
+	b := writeConfig(t, dir, "b.yaml", listenerConfig("l2", 10002, "x"))
+	p.ProcessFile(watcher.NotifyMessage{Operation: watcher.Create, FilePath: b})
+
+	versions, _ = receiveDelta(t, ch)
+	_, names := receiveDelta(t, watchDeltaListeners(c, node, versions))
+	if want := []string{"l1", "l2"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("listeners sent after adding b.yaml = %v, want %v", names, want)
+	}
+}
+
+// A new group that fails to build is not selected, so its nodes stay on
+// the group they are served from.
+func TestFailedGroupIsNotSelected(t *testing.T) {
+	dir := t.TempDir()
+	a := writeConfig(t, dir, "a.yaml", listenerConfig("l1", 10001))
+
+	c, p := newTestProcessor()
+	p.ProcessFiles([]string{a})
+
+	// b.yaml defines l1 again, so the group of node x cannot be merged
+	b := writeConfig(t, dir, "b.yaml", listenerConfig("l1", 10002, "x"))
+	p.ProcessFile(watcher.NotifyMessage{Operation: watcher.Create, FilePath: b})
+
+	node := &core.Node{Id: "x"}
+	if key := p.nodeHash.ID(node); key != xdscache.DefaultNodeGroup {
+		t.Errorf("node is hashed to %q, want %q", key, xdscache.DefaultNodeGroup)
+	}
+	if _, names := receive(t, watchListeners(c, node, "")); !reflect.DeepEqual(names, []string{"l1"}) {
+		t.Errorf("listeners = %v, want [l1]", names)
+	}
+}
+
+// Resource types that did not change keep their version while the groups
+// stay the same.
+func TestUnchangedTypesKeepVersion(t *testing.T) {
+	dir := t.TempDir()
+	a := writeConfig(t, dir, "a.yaml", listenerConfig("l1", 10001))
+
+	c, p := newTestProcessor()
+	p.ProcessFiles([]string{a})
+
+	node := &core.Node{Id: "x"}
+	version, _ := receive(t, watchListeners(c, node, ""))
+	versions, _ := receiveDelta(t, watchDeltaListeners(c, node, nil))
+
+	p.ProcessFile(watcher.NotifyMessage{Operation: watcher.Modify, FilePath: a})
+	select {
+	case <-watchListeners(c, node, version):
+		t.Fatal("unchanged listeners were sent again")
+	case <-watchDeltaListeners(c, node, versions):
+		t.Fatal("unchanged listeners were sent again over delta xDS")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func newTestProcessor() (cache.SnapshotCache, *Processor) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	nodeHash := xdscache.NewNodeHash(resources.ConfigSource{ClusterName: resources.DefaultXDSCluster}, nil)
+	c := cache.NewSnapshotCache(false, nodeHash, log)
+	return c, NewProcessor(c, nodeHash, log)
+}
+
+// listenerConfig returns a config serving a listener and cluster named
+// name, selecting the nodes with the given IDs.
+func listenerConfig(name string, port int, ids ...string) string {
+	config := "name: " + name + "\nspec:\n"
+	if len(ids) > 0 {
+		config += "  nodes:\n    ids: [" + strings.Join(ids, ", ") + "]\n"
+	}
+	return config + `  listeners:
+  - name: ` + name + `
+    address: 0.0.0.0
+    port: ` + strconv.Itoa(port) + `
+    routes:
+    - name: r
+      prefix: /
+      clusters: [` + name + `]
+  clusters:
+  - name: ` + name + `
+    endpoints:
+    - address: 127.0.0.1
+      port: 9101
+`
+}
+
+func writeConfig(t *testing.T, dir, name, config string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// watchListeners opens a listener watch for node, as if it held version.
+func watchListeners(c cache.SnapshotCache, node *core.Node, version string) chan cache.Response {
+	ch := make(chan cache.Response, 1)
+	c.CreateWatch(&discovery.DiscoveryRequest{
+		Node:        node,
+		TypeUrl:     resource.ListenerType,
+		VersionInfo: version,
+	}, stream.NewStreamState(true, nil), ch)
+	return ch
+}
+
+// watchRoutes opens a route watch for node, as if it held version.
+func watchRoutes(c cache.SnapshotCache, node *core.Node, version string) chan cache.Response {
+	ch := make(chan cache.Response, 1)
+	c.CreateWatch(&discovery.DiscoveryRequest{
+		Node:        node,
+		TypeUrl:     resource.RouteType,
+		VersionInfo: version,
+	}, stream.NewStreamState(true, nil), ch)
+	return ch
+}
+
+// receiveBody returns the version and the direct response body of the
+// only route in the response to a route watch.
+func receiveBody(t *testing.T, ch chan cache.Response) (string, string) {
+	t.Helper()
+	select {
+	case resp := <-ch:
+		raw := resp.(*cache.RawResponse)
+		if len(raw.Resources) != 1 {
+			t.Fatalf("got %d route configs, want 1", len(raw.Resources))
+		}
+		rc := raw.Resources[0].Resource.(*route.RouteConfiguration)
+		return raw.Version, rc.VirtualHosts[0].Routes[0].GetDirectResponse().GetBody().GetInlineString()
+	case <-time.After(time.Second):
+		t.Fatal("no response within 1s")
+	}
+	return "", ""
+}
+
+// receive returns the version and sorted resource names of the response
+// to a watch.
+func receive(t *testing.T, ch chan cache.Response) (string, []string) {
+	t.Helper()
+	select {
+	case resp := <-ch:
+		raw := resp.(*cache.RawResponse)
+		var names []string
+		for _, r := range raw.Resources {
+			names = append(names, cache.GetResourceName(r.Resource))
+		}
+		sort.Strings(names)
+		return raw.Version, names
+	case <-time.After(time.Second):
+		t.Fatal("no response within 1s")
+	}
+	return "", nil
+}
+
+// watchDeltaListeners opens a delta listener watch for node, as if it held
+// the given resource versions.
+func watchDeltaListeners(c cache.SnapshotCache, node *core.Node, versions map[string]string) chan cache.DeltaResponse {
+	state := stream.NewStreamState(true, nil)
+	if versions != nil {
+		state.SetResourceVersions(versions)
+	}
+	ch := make(chan cache.DeltaResponse, 1)
+	c.CreateDeltaWatch(&discovery.DeltaDiscoveryRequest{
+		Node:    node,
+		TypeUrl: resource.ListenerType,
+	}, state, ch)
+	return ch
+}
+
+// receiveDelta returns the resource versions held after the response to a
+// delta watch, and the sorted names of the resources it sent.
+func receiveDelta(t *testing.T, ch chan cache.DeltaResponse) (map[string]string, []string) {
+	t.Helper()
+	select {
+	case resp := <-ch:
+		raw := resp.(*cache.RawDeltaResponse)
+		var names []string
+		for _, r := range raw.Resources {
+			names = append(names, cache.GetResourceName(r))
+		}
+		sort.Strings(names)
+		return raw.NextVersionMap, names
+	case <-time.After(time.Second):
+		t.Fatal("no response within 1s")
+	}
+	return nil, nil
+}
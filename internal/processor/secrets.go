@@ -0,0 +1,173 @@
+//   Copyright Steve Sloka 2021
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package processor
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/stevesloka/envoy-xds-server/apis/v1alpha1"
+	"github.com/stevesloka/envoy-xds-server/internal/resources"
+)
+
+// loadSecret reads the PEM files of a secret, checking that they hold a
+// usable certificate and key, or at least one CA certificate.
+func loadSecret(s v1alpha1.Secret) (resources.Secret, error) {
+	secret := resources.Secret{Name: s.Name}
+
+	if s.TrustedCA != "" {
+		ca, err := ioutil.ReadFile(s.TrustedCA)
+		if err != nil {
+			return secret, fmt.Errorf("error reading trustedCA: %v", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(ca) {
+			return secret, fmt.Errorf("no certificates found in %s", s.TrustedCA)
+		}
+		secret.TrustedCA = ca
+		return secret, nil
+	}
+
+	chain, err := ioutil.ReadFile(s.CertificateChain)
+	if err != nil {
+		return secret, fmt.Errorf("error reading certificateChain: %v", err)
+	}
+	key, err := ioutil.ReadFile(s.PrivateKey)
+	if err != nil {
+		return secret, fmt.Errorf("error reading privateKey: %v", err)
+	}
+	if _, err := tls.X509KeyPair(chain, key); err != nil {
+		return secret, fmt.Errorf("invalid certificate and key: %v", err)
+	}
+	secret.CertificateChain = chain
+	secret.PrivateKey = key
+
+	return secret, nil
+}
+
+// expiryWarning is how long before a certificate expires that its expiry
+// is logged as a warning.
+const expiryWarning = 30 * 24 * time.Hour
+
+// logExpiry logs when the first certificate in a PEM file expires, each
+// time the file's expiry changes.
+func (p *Processor) logExpiry(path string, data []byte) {
+	expiry, err := certificateExpiry(data)
+	if err != nil {
+		p.Errorf("error reading certificates in %s: %v", path, err)
+		return
+	}
+	if p.expiries[path].Equal(expiry) {
+		return
+	}
+	p.expiries[path] = expiry
+
+	switch left := time.Until(expiry); {
+	case left <= 0:
+		p.Errorf("certificate %s expired on %s", path, expiry.Format(time.RFC3339))
+	case left <= expiryWarning:
+		p.Warnf("certificate %s expires on %s", path, expiry.Format(time.RFC3339))
+	default:
+		p.Infof("certificate %s expires on %s", path, expiry.Format(time.RFC3339))
+	}
+}
+
+// certificateExpiry returns the earliest expiry of the certificates in a
+// PEM encoded bundle.
+func certificateExpiry(data []byte) (time.Time, error) {
+	var expiry time.Time
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return expiry, err
+		}
+		if expiry.IsZero() || cert.NotAfter.Before(expiry) {
+			expiry = cert.NotAfter
+		}
+	}
+
+	if expiry.IsZero() {
+		return expiry, fmt.Errorf("no certificates found")
+	}
+	return expiry, nil
+}
+
+// checkSecretRefs checks that every secret referenced by a listener or
+// cluster exists, and is of the kind it is used as.
+func checkSecretRefs(spec *v1alpha1.Spec) error {
+	isCA := make(map[string]bool)
+	for _, s := range spec.Secrets {
+		isCA[s.Name] = s.TrustedCA != ""
+	}
+
+	check := func(name string, wantCA bool) error {
+		ca, ok := isCA[name]
+		switch {
+		case !ok:
+			return fmt.Errorf("secret %q is not defined", name)
+		case wantCA && !ca:
+			return fmt.Errorf("secret %q is not a trustedCA", name)
+		case !wantCA && ca:
+			return fmt.Errorf("secret %q is not a certificate", name)
+		}
+		return nil
+	}
+
+	for _, l := range spec.Listeners {
+		if l.TLS == nil {
+			continue
+		}
+		for _, name := range l.TLS.CertificateSecrets {
+			if err := check(name, false); err != nil {
+				return fmt.Errorf("listener %q: %v", l.Name, err)
+			}
+		}
+		if name := l.TLS.ClientCASecret; name != "" {
+			if err := check(name, true); err != nil {
+				return fmt.Errorf("listener %q: %v", l.Name, err)
+			}
+		}
+	}
+
+	for _, c := range spec.Clusters {
+		if c.TLS == nil {
+			continue
+		}
+		if name := c.TLS.CASecret; name != "" {
+			if err := check(name, true); err != nil {
+				return fmt.Errorf("cluster %q: %v", c.Name, err)
+			}
+		}
+		if name := c.TLS.ClientCertificateSecret; name != "" {
+			if err := check(name, false); err != nil {
+				return fmt.Errorf("cluster %q: %v", c.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,790 @@
+//   Copyright Steve Sloka 2021
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package processor
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/stevesloka/envoy-xds-server/apis/v1alpha1"
+	"github.com/stevesloka/envoy-xds-server/internal/resources"
+)
+
+// fractionDenominatorValues holds the value of each fraction denominator.
+var fractionDenominatorValues = map[envoytype.FractionalPercent_DenominatorType]uint32{
+	envoytype.FractionalPercent_HUNDRED:      100,
+	envoytype.FractionalPercent_TEN_THOUSAND: 10000,
+	envoytype.FractionalPercent_MILLION:      1000000,
+}
+
+// maxDirectResponseBodySize is the largest direct response body Envoy
+// accepts by default.
+const maxDirectResponseBodySize = 4096
+
+// httpMethod matches a valid HTTP method token.
+var httpMethod = regexp.MustCompile(`^[A-Z]+$`)
+
+// validateConfig checks a parsed config for mistakes Envoy would reject or
+// silently misinterpret, so a bad file never replaces a good one.
+func validateConfig(config *v1alpha1.EnvoyConfig) error {
+	for _, l := range config.Listeners {
+		if err := validateDownstreamTLS(l.TLS); err != nil {
+			return fmt.Errorf("listener %q: tls: %v", l.Name, err)
+		}
+
+		if err := validateListenerProtocol(l); err != nil {
+			return fmt.Errorf("listener %q: %v", l.Name, err)
+		}
+
+		vhosts := listenerVirtualHosts(l)
+		if err := validateVirtualHosts(vhosts); err != nil {
+			return fmt.Errorf("listener %q: %v", l.Name, err)
+		}
+
+		for _, vh := range vhosts {
+			if err := validateTimeouts(vh.Timeout, vh.IdleTimeout, vh.RetryPolicy); err != nil {
+				return fmt.Errorf("listener %q virtual host %q: %v", l.Name, vh.Name, err)
+			}
+
+			for _, r := range vh.Routes {
+				if err := validateRoute(r); err != nil {
+					return fmt.Errorf("listener %q virtual host %q route %q: %v", l.Name, vh.Name, r.Name, err)
+				}
+			}
+		}
+	}
+
+	for _, c := range config.Clusters {
+		if err := validateCluster(c); err != nil {
+			return fmt.Errorf("cluster %q: %v", c.Name, err)
+		}
+	}
+
+	for _, s := range config.Secrets {
+		if err := validateSecret(s); err != nil {
+			return fmt.Errorf("secret %q: %v", s.Name, err)
+		}
+	}
+
+	for _, l := range config.Runtime {
+		if err := validateRuntimeLayer(l); err != nil {
+			return fmt.Errorf("runtime layer %q: %v", l.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// validateRuntimeLayer checks that a runtime layer only holds values Envoy
+// can read, and that no key is both a value and a fractional percentage.
+func validateRuntimeLayer(l v1alpha1.RuntimeLayer) error {
+	if l.Name == "" {
+		return fmt.Errorf("runtime layer name is empty")
+	}
+
+	for key, value := range l.Values {
+		if _, ok := runtimeValue(value); !ok {
+			return fmt.Errorf("value of %q must be a boolean, number or string", key)
+		}
+	}
+
+	for key, fp := range l.FractionalPercents {
+		if _, ok := l.Values[key]; ok {
+			return fmt.Errorf("%q is set as both a value and a fractional percent", key)
+		}
+		denominator, ok := resources.FractionDenominators[fp.Denominator]
+		if !ok {
+			return fmt.Errorf("%q: denominator must be hundred, ten_thousand or million, not %q", key, fp.Denominator)
+		}
+		if max := fractionDenominatorValues[denominator]; fp.Numerator > max {
+			return fmt.Errorf("%q: numerator %d is more than its denominator %d", key, fp.Numerator, max)
+		}
+	}
+
+	return nil
+}
+
+// validateListenerProtocol checks that a listener only has the settings of
+// its protocol: routes for http listeners, clusters for tcp listeners.
+func validateListenerProtocol(l v1alpha1.Listener) error {
+	switch l.Protocol {
+	case "", resources.ProtocolHTTP:
+		if len(l.Clusters) > 0 || l.IdleTimeout != nil {
+			return fmt.Errorf("clusters and idleTimeout only apply to tcp listeners")
+		}
+	case resources.ProtocolTCP:
+		if len(l.Routes) > 0 || len(l.VirtualHosts) > 0 {
+			return fmt.Errorf("routes and virtualHosts only apply to http listeners")
+		}
+		if err := validateRouteClusters(l.Clusters); err != nil {
+			return err
+		}
+		if len(l.Clusters) > 1 {
+			for _, c := range l.Clusters {
+				if c.Weight != nil && *c.Weight == 0 {
+					return fmt.Errorf("cluster %q: weight must be at least 1", c.Name)
+				}
+			}
+		}
+		if l.IdleTimeout != nil && *l.IdleTimeout < 0 {
+			return fmt.Errorf("idleTimeout must not be negative")
+		}
+	default:
+		return fmt.Errorf("protocol must be http or tcp, not %q", l.Protocol)
+	}
+	return nil
+}
+
+// validateSecret checks that a secret is either a certificate and its key,
+// or a CA bundle.
+func validateSecret(s v1alpha1.Secret) error {
+	if s.Name == "" {
+		return fmt.Errorf("secret name is empty")
+	}
+
+	if s.TrustedCA != "" {
+		if s.CertificateChain != "" || s.PrivateKey != "" {
+			return fmt.Errorf("trustedCA can not be combined with certificateChain or privateKey")
+		}
+		return nil
+	}
+
+	if s.CertificateChain == "" || s.PrivateKey == "" {
+		return fmt.Errorf("either certificateChain and privateKey, or trustedCA, must be set")
+	}
+	return nil
+}
+
+// validateDownstreamTLS checks the TLS settings of a listener.
+func validateDownstreamTLS(t *v1alpha1.DownstreamTLS) error {
+	if t == nil {
+		return nil
+	}
+
+	if len(t.CertificateSecrets) == 0 {
+		return fmt.Errorf("at least one certificateSecret is needed")
+	}
+	if t.RequireClientCertificate && t.ClientCASecret == "" {
+		return fmt.Errorf("requireClientCertificate needs a clientCASecret to validate them with")
+	}
+
+	for _, v := range []string{t.MinVersion, t.MaxVersion} {
+		if _, ok := resources.TLSVersions[v]; v != "" && !ok {
+			return fmt.Errorf("TLS version must be 1.0, 1.1, 1.2 or 1.3, not %q", v)
+		}
+	}
+	if t.MinVersion != "" && t.MaxVersion != "" && t.MinVersion > t.MaxVersion {
+		return fmt.Errorf("minVersion %s is newer than maxVersion %s", t.MinVersion, t.MaxVersion)
+	}
+
+	return nil
+}
+
+// validateCluster checks the settings of a cluster.
+func validateCluster(c v1alpha1.Cluster) error {
+	if c.Name == "" {
+		return fmt.Errorf("cluster name is empty")
+	}
+
+	if rb := c.RetryBudget; rb != nil {
+		if rb.BudgetPercent != nil && (*rb.BudgetPercent < 0 || *rb.BudgetPercent > 100) {
+			return fmt.Errorf("retryBudget: budgetPercent must be between 0 and 100")
+		}
+	}
+
+	if c.ConnectTimeout != nil && *c.ConnectTimeout <= 0 {
+		return fmt.Errorf("connectTimeout must be positive")
+	}
+	if c.DNSLookupFamily != "" {
+		if _, ok := resources.DNSLookupFamilies[c.DNSLookupFamily]; !ok {
+			return fmt.Errorf("unknown dnsLookupFamily %q", c.DNSLookupFamily)
+		}
+	}
+
+	priorities := make(map[core.RoutingPriority]bool)
+	for _, cb := range c.CircuitBreakers {
+		priority, ok := resources.RoutingPriorities[cb.Priority]
+		if !ok {
+			return fmt.Errorf("circuitBreakers: priority must be default or high, not %q", cb.Priority)
+		}
+		if priorities[priority] {
+			return fmt.Errorf("circuitBreakers: priority %s is listed more than once", strings.ToLower(priority.String()))
+		}
+		priorities[priority] = true
+	}
+
+	if err := validateEndpoints(c.Endpoints); err != nil {
+		return fmt.Errorf("endpoints: %v", err)
+	}
+
+	if err := validateClusterType(c); err != nil {
+		return err
+	}
+
+	if err := validateUpstreamTLS(c.TLS); err != nil {
+		return fmt.Errorf("tls: %v", err)
+	}
+
+	if err := validateOutlierDetection(c.OutlierDetection); err != nil {
+		return fmt.Errorf("outlierDetection: %v", err)
+	}
+
+	for i, hc := range c.HealthChecks {
+		if err := validateHealthCheck(hc); err != nil {
+			return fmt.Errorf("health check %d: %v", i, err)
+		}
+	}
+
+	return validateLbPolicy(c)
+}
+
+// validateClusterType checks that a cluster's endpoints suit its discovery
+// type: IP addresses for static clusters, and a single endpoint for
+// logical_dns clusters, which only ever connect to one resolved address.
+func validateClusterType(c v1alpha1.Cluster) error {
+	if c.Type != "" {
+		if _, ok := resources.ClusterTypes[c.Type]; !ok {
+			return fmt.Errorf("type must be eds, static, strict_dns or logical_dns, not %q", c.Type)
+		}
+	}
+
+	switch c.Type {
+	case "static":
+		for _, e := range c.Endpoints {
+			if net.ParseIP(e.Address) == nil {
+				return fmt.Errorf("static clusters need IP addresses, not %q", e.Address)
+			}
+		}
+	case "logical_dns":
+		if len(c.Endpoints) != 1 {
+			return fmt.Errorf("logical_dns clusters need exactly one endpoint")
+		}
+	}
+
+	switch c.Type {
+	case "strict_dns", "logical_dns":
+		if c.DNSRefreshRate != nil && *c.DNSRefreshRate < time.Millisecond {
+			return fmt.Errorf("dnsRefreshRate must be at least 1ms")
+		}
+	default:
+		if c.DNSRefreshRate != nil || c.RespectDNSTTL {
+			return fmt.Errorf("dnsRefreshRate and respectDnsTtl only apply to strict_dns and logical_dns clusters")
+		}
+	}
+
+	return nil
+}
+
+// validateEndpoints checks endpoint weights and localities, and that
+// priorities are used without gaps, as Envoy requires.
+func validateEndpoints(endpoints []v1alpha1.Endpoint) error {
+	priorities := make(map[uint32]bool)
+	for _, e := range endpoints {
+		if e.Weight != nil && *e.Weight == 0 {
+			return fmt.Errorf("%s:%d: weight must be at least 1", e.Address, e.Port)
+		}
+		if _, ok := resources.HealthStatuses[e.Health]; !ok {
+			return fmt.Errorf("%s:%d: health must be healthy, draining, unhealthy or degraded, not %q", e.Address, e.Port, e.Health)
+		}
+		if e.SubZone != "" && e.Zone == "" {
+			return fmt.Errorf("%s:%d: subZone needs a zone", e.Address, e.Port)
+		}
+		priorities[e.Priority] = true
+	}
+
+	for p := range priorities {
+		if p > 0 && !priorities[p-1] {
+			return fmt.Errorf("priority %d is used without priority %d", p, p-1)
+		}
+	}
+	return nil
+}
+
+// validateHealthCheck checks a health check's type specific settings, and
+// that its timings are sane: positive, with the timeout and jitter shorter
+// than the interval.
+func validateHealthCheck(hc v1alpha1.HealthCheck) error {
+	switch hc.Type {
+	case "http":
+		if !strings.HasPrefix(hc.Path, "/") {
+			return fmt.Errorf("http health checks need a path starting with '/'")
+		}
+		for _, r := range hc.ExpectedStatuses {
+			if r.Start < 100 || r.End > 599 || r.Start > r.End {
+				return fmt.Errorf("invalid expected status range %d-%d", r.Start, r.End)
+			}
+		}
+	case "tcp", "grpc":
+		if hc.Path != "" || len(hc.ExpectedStatuses) > 0 {
+			return fmt.Errorf("path and expectedStatuses only apply to http health checks")
+		}
+	default:
+		return fmt.Errorf("type must be http, tcp or grpc, not %q", hc.Type)
+	}
+	if hc.ServiceName != "" && hc.Type != "grpc" {
+		return fmt.Errorf("serviceName only applies to grpc health checks")
+	}
+
+	interval := resources.DefaultHealthCheckInterval
+	if hc.Interval != nil {
+		interval = *hc.Interval
+	}
+	timeout := resources.DefaultHealthCheckTimeout
+	if hc.Timeout != nil {
+		timeout = *hc.Timeout
+	}
+
+	switch {
+	case interval <= 0:
+		return fmt.Errorf("interval must be positive")
+	case timeout <= 0:
+		return fmt.Errorf("timeout must be positive")
+	case timeout > interval:
+		return fmt.Errorf("timeout %s is longer than the interval %s", timeout, interval)
+	case hc.Jitter != nil && (*hc.Jitter < 0 || *hc.Jitter >= interval):
+		return fmt.Errorf("jitter must not be negative or as long as the interval %s", interval)
+	case hc.HealthyThreshold != nil && *hc.HealthyThreshold == 0:
+		return fmt.Errorf("healthyThreshold must be at least 1")
+	case hc.UnhealthyThreshold != nil && *hc.UnhealthyThreshold == 0:
+		return fmt.Errorf("unhealthyThreshold must be at least 1")
+	}
+
+	return nil
+}
+
+func validateUpstreamTLS(t *v1alpha1.UpstreamTLS) error {
+	if t == nil {
+		return nil
+	}
+
+	if len(t.SubjectAltNames) > 0 && t.CASecret == "" {
+		return fmt.Errorf("subjectAltNames can only be checked with a caSecret")
+	}
+
+	for _, san := range t.SubjectAltNames {
+		if _, ok := resources.SubjectAltNameTypes[san.Type]; !ok {
+			return fmt.Errorf("subjectAltNames: type must be dns, uri, email or ip_address, not %q", san.Type)
+		}
+
+		var matches int
+		for _, m := range []string{san.Exact, san.Prefix, san.Suffix, san.Regex} {
+			if m != "" {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("subjectAltNames: exactly one of exact, prefix, suffix and regex must be set")
+		}
+
+		if san.Regex != "" {
+			if _, err := regexp.Compile(san.Regex); err != nil {
+				return fmt.Errorf("subjectAltNames: invalid regex: %v", err)
+			}
+		}
+	}
+
+	for _, p := range t.ALPN {
+		if p == "" {
+			return fmt.Errorf("alpn: protocol is empty")
+		}
+	}
+
+	return nil
+}
+
+func validateOutlierDetection(od *v1alpha1.OutlierDetection) error {
+	if od == nil {
+		return nil
+	}
+
+	switch {
+	case od.Consecutive5xx != nil && *od.Consecutive5xx == 0:
+		return fmt.Errorf("consecutive5xx must be at least 1")
+	case od.ConsecutiveGatewayFailure != nil && *od.ConsecutiveGatewayFailure == 0:
+		return fmt.Errorf("consecutiveGatewayFailure must be at least 1")
+	case od.Interval != nil && *od.Interval <= 0:
+		return fmt.Errorf("interval must be positive")
+	case od.BaseEjectionTime != nil && *od.BaseEjectionTime <= 0:
+		return fmt.Errorf("baseEjectionTime must be positive")
+	case od.MaxEjectionPercent != nil && *od.MaxEjectionPercent > 100:
+		return fmt.Errorf("maxEjectionPercent must be at most 100")
+	}
+
+	if sr := od.SuccessRate; sr != nil && sr.EnforcingPercent != nil && *sr.EnforcingPercent > 100 {
+		return fmt.Errorf("successRate: enforcingPercent must be at most 100")
+	}
+
+	return nil
+}
+
+// validateLbPolicy checks a cluster's load balancing policy, and that only
+// the settings of that policy are given.
+func validateLbPolicy(c v1alpha1.Cluster) error {
+	policy := c.LbPolicy
+	if policy == "" {
+		policy = resources.DefaultLbPolicy
+	}
+	if _, ok := resources.LbPolicies[policy]; !ok {
+		return fmt.Errorf("unknown lbPolicy %q", c.LbPolicy)
+	}
+
+	switch {
+	case c.LeastRequest != nil && policy != "least_request":
+		return fmt.Errorf("leastRequest only applies to the least_request lbPolicy")
+	case c.RingHash != nil && policy != "ring_hash":
+		return fmt.Errorf("ringHash only applies to the ring_hash lbPolicy")
+	case c.Maglev != nil && policy != "maglev":
+		return fmt.Errorf("maglev only applies to the maglev lbPolicy")
+	}
+
+	if lr := c.LeastRequest; lr != nil && lr.ChoiceCount != nil && *lr.ChoiceCount < 2 {
+		return fmt.Errorf("leastRequest: choiceCount must be at least 2")
+	}
+
+	if rh := c.RingHash; rh != nil {
+		if rh.MaximumRingSize != nil && *rh.MaximumRingSize > maxRingSize {
+			return fmt.Errorf("ringHash: maximumRingSize must be at most %d", maxRingSize)
+		}
+		if rh.MinimumRingSize != nil && rh.MaximumRingSize != nil && *rh.MinimumRingSize > *rh.MaximumRingSize {
+			return fmt.Errorf("ringHash: minimumRingSize must not be larger than maximumRingSize")
+		}
+	}
+
+	if m := c.Maglev; m != nil && m.TableSize != nil {
+		size := *m.TableSize
+		if size > maxMaglevTableSize || !new(big.Int).SetUint64(size).ProbablyPrime(0) {
+			return fmt.Errorf("maglev: tableSize must be a prime number no larger than %d", maxMaglevTableSize)
+		}
+	}
+
+	return nil
+}
+
+// validateVirtualHosts checks the virtual hosts of a route configuration.
+// Envoy selects a virtual host by domain, so every domain may only be
+// claimed by one of them.
+func validateVirtualHosts(vhosts []v1alpha1.VirtualHost) error {
+	names := make(map[string]bool)
+	domains := make(map[string]string)
+	for _, vh := range vhosts {
+		if vh.Name == "" {
+			return fmt.Errorf("virtual host name is empty")
+		}
+		if names[vh.Name] {
+			return fmt.Errorf("virtual host %q is defined more than once", vh.Name)
+		}
+		names[vh.Name] = true
+
+		if len(vh.Domains) == 0 {
+			return fmt.Errorf("virtual host %q has no domains", vh.Name)
+		}
+		for _, d := range vh.Domains {
+			if err := validateDomain(d); err != nil {
+				return fmt.Errorf("virtual host %q: %v", vh.Name, err)
+			}
+
+			// Envoy matches domains case-insensitively
+			key := strings.ToLower(d)
+			if other, ok := domains[key]; ok {
+				return fmt.Errorf("domain %q is claimed by both virtual host %q and %q", d, other, vh.Name)
+			}
+			domains[key] = vh.Name
+		}
+	}
+
+	return nil
+}
+
+// validateDomain checks a virtual host domain. Only a single wildcard at the
+// start or end of the domain is supported.
+func validateDomain(domain string) error {
+	switch {
+	case domain == "":
+		return fmt.Errorf("domain is empty")
+	case domain == "*":
+		return nil
+	case strings.Count(domain, "*") > 1:
+		return fmt.Errorf("domain %q has more than one wildcard", domain)
+	case len(domain) > 2 && strings.Contains(domain[1:len(domain)-1], "*"):
+		return fmt.Errorf("domain %q has a wildcard that is not at its start or end", domain)
+	case strings.ContainsAny(domain, " /"):
+		return fmt.Errorf("domain %q is not a valid host name", domain)
+	}
+
+	return nil
+}
+
+// validateRoute checks the conditions a route matches requests on and the
+// clusters it sends them to.
+func validateRoute(r v1alpha1.Route) error {
+	var specifiers int
+	for _, s := range []string{r.Prefix, r.Path, r.Regex, r.PathSeparatedPrefix} {
+		if s != "" {
+			specifiers++
+		}
+	}
+	if specifiers > 1 {
+		return fmt.Errorf("only one of prefix, path, regex and pathSeparatedPrefix may be set")
+	}
+
+	if r.Regex != "" {
+		if _, err := regexp.Compile(r.Regex); err != nil {
+			return fmt.Errorf("invalid regex: %v", err)
+		}
+	}
+
+	if p := r.PathSeparatedPrefix; p != "" {
+		if !strings.HasPrefix(p, "/") || strings.HasSuffix(p, "/") || strings.ContainsAny(p, "?#") {
+			return fmt.Errorf("pathSeparatedPrefix %q must start with a '/', not end with one, and not contain '?' or '#'", p)
+		}
+	}
+
+	for _, m := range r.Methods {
+		if !httpMethod.MatchString(m) {
+			return fmt.Errorf("invalid HTTP method %q", m)
+		}
+	}
+
+	for _, h := range r.Headers {
+		if err := validateValueMatch("header", h.Name, h.Exact, h.Regex); err != nil {
+			return err
+		}
+	}
+
+	for _, q := range r.QueryParams {
+		if err := validateValueMatch("query parameter", q.Name, q.Exact, q.Regex); err != nil {
+			return err
+		}
+	}
+
+	return validateRouteAction(r)
+}
+
+// validateRouteAction checks that a route takes exactly one action: forward
+// to clusters, redirect, or respond directly.
+func validateRouteAction(r v1alpha1.Route) error {
+	var actions int
+	if len(r.Clusters) > 0 {
+		actions++
+	}
+	if r.Redirect != nil {
+		actions++
+	}
+	if r.DirectResponse != nil {
+		actions++
+	}
+	switch {
+	case actions == 0:
+		return fmt.Errorf("one of clusters, redirect and directResponse must be set")
+	case actions > 1:
+		return fmt.Errorf("only one of clusters, redirect and directResponse may be set")
+	}
+
+	if len(r.Clusters) == 0 && (r.PrefixRewrite != "" || r.RegexRewrite != nil || r.HostRewrite != "") {
+		return fmt.Errorf("rewrites only apply to routes that forward to clusters")
+	}
+	if len(r.Clusters) == 0 && (r.Timeout != nil || r.IdleTimeout != nil || r.RetryPolicy != nil) {
+		return fmt.Errorf("timeouts and retries only apply to routes that forward to clusters")
+	}
+	if err := validateTimeouts(r.Timeout, r.IdleTimeout, r.RetryPolicy); err != nil {
+		return err
+	}
+
+	if r.Redirect != nil {
+		return validateRedirect(r.Redirect)
+	}
+	if r.DirectResponse != nil {
+		return validateDirectResponse(r.DirectResponse)
+	}
+
+	if rr := r.RegexRewrite; rr != nil {
+		if rr.Pattern == "" {
+			return fmt.Errorf("regexRewrite pattern is empty")
+		}
+		if _, err := regexp.Compile(rr.Pattern); err != nil {
+			return fmt.Errorf("regexRewrite: invalid pattern: %v", err)
+		}
+		if r.PrefixRewrite != "" {
+			return fmt.Errorf("only one of prefixRewrite and regexRewrite may be set")
+		}
+	}
+
+	return validateRouteClusters(r.Clusters)
+}
+
+// Limits Envoy places on hash-based load balancers.
+const (
+	maxRingSize        = 8388608
+	maxMaglevTableSize = 5000011
+)
+
+// retryConditions holds the conditions Envoy can retry a request on.
+var retryConditions = map[string]bool{
+	"5xx":                        true,
+	"gateway-error":              true,
+	"reset":                      true,
+	"connect-failure":            true,
+	"envoy-ratelimited":          true,
+	"retriable-4xx":              true,
+	"refused-stream":             true,
+	"retriable-status-codes":     true,
+	"retriable-headers":          true,
+	"http3-post-connect-failure": true,
+	// gRPC status codes
+	"cancelled":          true,
+	"deadline-exceeded":  true,
+	"internal":           true,
+	"resource-exhausted": true,
+	"unavailable":        true,
+}
+
+// validateTimeouts checks the timeouts and retry policy of a route or
+// virtual host.
+func validateTimeouts(timeout, idleTimeout *time.Duration, rp *v1alpha1.RetryPolicy) error {
+	if timeout != nil && *timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if idleTimeout != nil && *idleTimeout < 0 {
+		return fmt.Errorf("idleTimeout must not be negative")
+	}
+	if rp == nil {
+		return nil
+	}
+
+	if len(rp.RetryOn) == 0 && len(rp.RetriableStatusCodes) == 0 {
+		return fmt.Errorf("retryPolicy: retryOn is empty")
+	}
+	for _, cond := range rp.RetryOn {
+		if !retryConditions[cond] {
+			return fmt.Errorf("retryPolicy: unknown retryOn condition %q", cond)
+		}
+	}
+	for _, code := range rp.RetriableStatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("retryPolicy: invalid retriable status code %d", code)
+		}
+	}
+	if rp.PerTryTimeout != nil && *rp.PerTryTimeout <= 0 {
+		return fmt.Errorf("retryPolicy: perTryTimeout must be positive")
+	}
+	if rp.PerTryTimeout != nil && timeout != nil && *timeout > 0 && *rp.PerTryTimeout > *timeout {
+		return fmt.Errorf("retryPolicy: perTryTimeout %s is longer than the timeout %s", *rp.PerTryTimeout, *timeout)
+	}
+	if bo := rp.BackOff; bo != nil {
+		if bo.BaseInterval <= 0 {
+			return fmt.Errorf("retryPolicy: backOff baseInterval must be positive")
+		}
+		if bo.MaxInterval != 0 && bo.MaxInterval < bo.BaseInterval {
+			return fmt.Errorf("retryPolicy: backOff maxInterval must not be shorter than baseInterval")
+		}
+	}
+
+	return nil
+}
+
+// redirectCodes holds the response codes Envoy can send a redirect with.
+var redirectCodes = map[uint32]bool{301: true, 302: true, 303: true, 307: true, 308: true}
+
+func validateRedirect(rd *v1alpha1.Redirect) error {
+	switch {
+	case rd.Path != "" && rd.PrefixRewrite != "":
+		return fmt.Errorf("redirect: only one of path and prefixRewrite may be set")
+	case rd.Scheme != "" && rd.Scheme != "http" && rd.Scheme != "https":
+		return fmt.Errorf("redirect: scheme must be http or https, not %q", rd.Scheme)
+	case rd.ResponseCode != 0 && !redirectCodes[rd.ResponseCode]:
+		return fmt.Errorf("redirect: unsupported response code %d", rd.ResponseCode)
+	case rd.Port > math.MaxUint16:
+		return fmt.Errorf("redirect: invalid port %d", rd.Port)
+	}
+
+	return nil
+}
+
+func validateDirectResponse(dr *v1alpha1.DirectResponse) error {
+	switch {
+	case dr.Status < 200 || dr.Status > 599:
+		return fmt.Errorf("directResponse: status must be between 200 and 599, not %d", dr.Status)
+	case dr.Body != "" && dr.BodyFile != "":
+		return fmt.Errorf("directResponse: only one of body and bodyFile may be set")
+	case len(dr.Body) > maxDirectResponseBodySize:
+		return fmt.Errorf("directResponse: body is %d bytes, more than the %d allowed", len(dr.Body), maxDirectResponseBodySize)
+	}
+
+	return nil
+}
+
+// validateValueMatch checks a header or query parameter match, which may
+// match on an exact value or a regex but not both.
+func validateValueMatch(kind, name, exact, regex string) error {
+	if name == "" {
+		return fmt.Errorf("%s name is empty", kind)
+	}
+	if exact != "" && regex != "" {
+		return fmt.Errorf("%s %q: only one of exact and regex may be set", kind, name)
+	}
+	if regex != "" {
+		if _, err := regexp.Compile(regex); err != nil {
+			return fmt.Errorf("%s %q: invalid regex: %v", kind, name, err)
+		}
+	}
+
+	return nil
+}
+
+// validateRouteClusters checks the clusters a route splits its traffic
+// between, and their weights.
+func validateRouteClusters(clusters []v1alpha1.RouteCluster) error {
+	if len(clusters) == 0 {
+		return fmt.Errorf("no clusters")
+	}
+
+	names := make(map[string]bool)
+	var weighted int
+	var total uint64
+	for _, c := range clusters {
+		if c.Name == "" {
+			return fmt.Errorf("cluster name is empty")
+		}
+		if names[c.Name] {
+			return fmt.Errorf("cluster %q is listed more than once", c.Name)
+		}
+		names[c.Name] = true
+
+		if c.Weight != nil {
+			weighted++
+			total += uint64(*c.Weight)
+		}
+	}
+
+	switch {
+	case weighted == 0:
+		return nil
+	case weighted != len(clusters):
+		return fmt.Errorf("either every cluster must have a weight or none may")
+	case total == 0:
+		return fmt.Errorf("cluster weights add up to zero")
+	case total > math.MaxUint32:
+		return fmt.Errorf("cluster weights add up to %d, more than %d", total, uint32(math.MaxUint32))
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+//   Copyright Steve Sloka 2021
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package processor
+
+import (
+	"testing"
+
+	"github.com/stevesloka/envoy-xds-server/apis/v1alpha1"
+	"gopkg.in/yaml.v2"
+)
+
+func TestValidateRoute(t *testing.T) {
+	tests := map[string]struct {
+		route   string
+		wantErr bool
+	}{
+		"prefix":                 {route: "{prefix: /, clusters: [c]}"},
+		"no specifier":           {route: "{clusters: [c]}"},
+		"prefix and path":        {route: "{prefix: /, path: /a, clusters: [c]}", wantErr: true},
+		"regex":                  {route: `{regex: "/api/v[0-9]+/.*", clusters: [c]}`},
+		"invalid regex":          {route: `{regex: "/api/(", clusters: [c]}`, wantErr: true},
+		"path separated prefix":  {route: "{pathSeparatedPrefix: /api, clusters: [c]}"},
+		"trailing slash":         {route: "{pathSeparatedPrefix: /api/, clusters: [c]}", wantErr: true},
+		"method":                 {route: "{methods: [GET], clusters: [c]}"},
+		"lower case method":      {route: "{methods: [get], clusters: [c]}", wantErr: true},
+		"header exact and regex": {route: "{headers: [{name: h, exact: a, regex: b}], clusters: [c]}", wantErr: true},
+		"invalid query regex":    {route: `{queryParams: [{name: q, regex: "("}], clusters: [c]}`, wantErr: true},
+		"no action":              {route: "{prefix: /}", wantErr: true},
+		"weights":                {route: "{clusters: [{name: a, weight: 1}, {name: b, weight: 3}]}"},
+		"partial weights":        {route: "{clusters: [{name: a, weight: 1}, b]}", wantErr: true},
+		"zero weights":           {route: "{clusters: [{name: a, weight: 0}, {name: b, weight: 0}]}", wantErr: true},
+		"weight overflow":        {route: "{clusters: [{name: a, weight: 4294967295}, {name: b, weight: 1}]}", wantErr: true},
+		"duplicate cluster":      {route: "{clusters: [a, a]}", wantErr: true},
+		"retry conditions":       {route: "{retryPolicy: {retryOn: [5xx, unavailable]}, clusters: [c]}"},
+		"unknown retry":          {route: "{retryPolicy: {retryOn: [sometimes]}, clusters: [c]}", wantErr: true},
+		"retriable status only":  {route: "{retryPolicy: {retriableStatusCodes: [503]}, clusters: [c]}"},
+		"invalid status code":    {route: "{retryPolicy: {retriableStatusCodes: [99]}, clusters: [c]}", wantErr: true},
+		"empty retry policy":     {route: "{retryPolicy: {numRetries: 2}, clusters: [c]}", wantErr: true},
+		"redirect":               {route: "{redirect: {host: example.com, responseCode: 308}}"},
+		"redirect code":          {route: "{redirect: {host: example.com, responseCode: 200}}", wantErr: true},
+		"redirect and clusters":  {route: "{redirect: {host: example.com}, clusters: [c]}", wantErr: true},
+		"redirect rewrite":       {route: "{redirect: {host: example.com}, prefixRewrite: /}", wantErr: true},
+		"direct response":        {route: "{directResponse: {status: 503, body: down}}"},
+		"direct response status": {route: "{directResponse: {status: 600}}", wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := parseSpec(t, "listeners: [{name: l, routes: [{name: r, "+tc.route[1:]+"]}]")
+			err := validateConfig(config)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("validateConfig() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateCluster(t *testing.T) {
+	tests := map[string]struct {
+		cluster string
+		wantErr bool
+	}{
+		"maglev":                  {cluster: "{lbPolicy: maglev, maglev: {tableSize: 65537}}"},
+		"maglev not prime":        {cluster: "{lbPolicy: maglev, maglev: {tableSize: 65536}}", wantErr: true},
+		"maglev too large":        {cluster: "{lbPolicy: maglev, maglev: {tableSize: 5000111}}", wantErr: true},
+		"maglev other policy":     {cluster: "{maglev: {tableSize: 65537}}", wantErr: true},
+		"priorities":              {cluster: "{endpoints: [{address: 10.0.0.1, port: 80}, {address: 10.0.0.2, port: 80, priority: 1}]}"},
+		"priority gap":            {cluster: "{endpoints: [{address: 10.0.0.1, port: 80}, {address: 10.0.0.2, port: 80, priority: 2}]}", wantErr: true},
+		"no priority 0":           {cluster: "{endpoints: [{address: 10.0.0.1, port: 80, priority: 1}]}", wantErr: true},
+		"endpoint weight":         {cluster: "{endpoints: [{address: 10.0.0.1, port: 80, weight: 0}]}", wantErr: true},
+		"static":                  {cluster: "{type: static, endpoints: [{address: 10.0.0.1, port: 80}, {address: '::1', port: 80}]}"},
+		"static host name":        {cluster: "{type: static, endpoints: [{address: example.com, port: 80}]}", wantErr: true},
+		"logical dns":             {cluster: "{type: logical_dns, endpoints: [{address: example.com, port: 443}]}"},
+		"logical dns two":         {cluster: "{type: logical_dns, endpoints: [{address: a.example.com, port: 443}, {address: b.example.com, port: 443}]}", wantErr: true},
+		"logical dns none":        {cluster: "{type: logical_dns}", wantErr: true},
+		"dns refresh rate":        {cluster: "{type: strict_dns, dnsRefreshRate: 30s, endpoints: [{address: example.com, port: 443}]}"},
+		"dns refresh rate on eds": {cluster: "{dnsRefreshRate: 30s}", wantErr: true},
+		"unknown type":            {cluster: "{type: dns}", wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := parseSpec(t, "clusters: [{name: c, "+tc.cluster[1:]+"]")
+			err := validateConfig(config)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("validateConfig() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckSecretRefs(t *testing.T) {
+	const secrets = `
+secrets:
+- {name: cert, certificateChain: tls.crt, privateKey: tls.key}
+- {name: ca, trustedCA: ca.crt}
+`
+	tests := map[string]struct {
+		spec    string
+		wantErr bool
+	}{
+		"listener certificate":     {spec: "listeners: [{name: l, tls: {certificateSecrets: [cert], clientCASecret: ca}}]"},
+		"undefined certificate":    {spec: "listeners: [{name: l, tls: {certificateSecrets: [missing]}}]", wantErr: true},
+		"ca as certificate":        {spec: "listeners: [{name: l, tls: {certificateSecrets: [ca]}}]", wantErr: true},
+		"certificate as client ca": {spec: "listeners: [{name: l, tls: {certificateSecrets: [cert], clientCASecret: cert}}]", wantErr: true},
+		"cluster ca":               {spec: "clusters: [{name: c, tls: {caSecret: ca}}]"},
+		"certificate as ca":        {spec: "clusters: [{name: c, tls: {caSecret: cert}}]", wantErr: true},
+		"undefined ca":             {spec: "clusters: [{name: c, tls: {caSecret: missing}}]", wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := parseSpec(t, secrets+tc.spec)
+			err := checkSecretRefs(&config.Spec)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("checkSecretRefs() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// parseSpec parses spec as the spec of a config.
+func parseSpec(t *testing.T, spec string) *v1alpha1.EnvoyConfig {
+	t.Helper()
+	var config v1alpha1.EnvoyConfig
+	if err := yaml.UnmarshalStrict([]byte(spec), &config.Spec); err != nil {
+		t.Fatalf("error parsing %s: %v", spec, err)
+	}
+	return &config
+}
@@ -14,25 +14,225 @@
 
 package resources
 
+import "time"
+
 type Listener struct {
-	Name       string
-	Address    string
-	Port       uint32
-	RouteNames []string
+	Name            string
+	Address         string
+	Port            uint32
+	Protocol        string
+	RouteConfigName string
+	Clusters        []WeightedCluster
+	IdleTimeout     *time.Duration
+	AccessLog       string
+	TLS             *DownstreamTLS
+}
+
+type DownstreamTLS struct {
+	CertificateSecrets       []string
+	ClientCASecret           string
+	RequireClientCertificate bool
+	MinVersion               string
+	MaxVersion               string
+	CipherSuites             []string
+	ALPN                     []string
+}
+
+// RuntimeLayer holds runtime values, each a bool, float64 or string, and
+// fractional percentages keyed by runtime key.
+type RuntimeLayer struct {
+	Name               string
+	Values             map[string]interface{}
+	FractionalPercents map[string]FractionalPercent
+}
+
+type FractionalPercent struct {
+	Numerator   uint32
+	Denominator string
+}
+
+// Secret holds PEM encoded certificate material. It is either a
+// certificate chain and private key, or a trusted CA bundle.
+type Secret struct {
+	Name             string
+	CertificateChain []byte
+	PrivateKey       []byte
+	TrustedCA        []byte
+}
+
+type RouteConfig struct {
+	Name         string
+	VirtualHosts []VirtualHost
+}
+
+type VirtualHost struct {
+	Name        string
+	Domains     []string
+	Routes      []Route
+	RetryPolicy *RetryPolicy
 }
 
 type Route struct {
-	Name    string
-	Prefix  string
-	Cluster string
+	Name           string
+	Match          RouteMatch
+	Clusters       []WeightedCluster
+	Redirect       *Redirect
+	DirectResponse *DirectResponse
+	Rewrite        Rewrite
+	Timeout        *time.Duration
+	IdleTimeout    *time.Duration
+	RetryPolicy    *RetryPolicy
+}
+
+type RetryPolicy struct {
+	RetryOn              []string
+	NumRetries           *uint32
+	PerTryTimeout        *time.Duration
+	BaseInterval         time.Duration
+	MaxInterval          time.Duration
+	RetriableStatusCodes []uint32
+}
+
+type Redirect struct {
+	Scheme        string
+	Host          string
+	Port          uint32
+	Path          string
+	PrefixRewrite string
+	ResponseCode  uint32
+	StripQuery    bool
+}
+
+type DirectResponse struct {
+	Status uint32
+	Body   string
+}
+
+type Rewrite struct {
+	Prefix            string
+	RegexPattern      string
+	RegexSubstitution string
+	Host              string
+}
+
+type RouteMatch struct {
+	Prefix              string
+	Path                string
+	Regex               string
+	PathSeparatedPrefix string
+	CaseSensitive       *bool
+	Methods             []string
+	Headers             []HeaderMatch
+	QueryParams         []QueryParamMatch
+}
+
+type HeaderMatch struct {
+	Name   string
+	Exact  string
+	Regex  string
+	Invert bool
+}
+
+type QueryParamMatch struct {
+	Name  string
+	Exact string
+	Regex string
+}
+
+type WeightedCluster struct {
+	Name   string
+	Weight uint32
 }
 
 type Cluster struct {
-	Name      string
-	Endpoints []Endpoint
+	Name                          string
+	Type                          string
+	Endpoints                     []Endpoint
+	DNSRefreshRate                *time.Duration
+	RespectDNSTTL                 bool
+	RetryBudget                   *RetryBudget
+	ConnectTimeout                time.Duration
+	LbPolicy                      string
+	LeastRequestChoiceCount       *uint32
+	RingHashMinimumSize           *uint64
+	RingHashMaximumSize           *uint64
+	MaglevTableSize               *uint64
+	DNSLookupFamily               string
+	PerConnectionBufferLimitBytes *uint32
+	HealthChecks                  []HealthCheck
+	CircuitBreakers               []CircuitBreaker
+	OutlierDetection              *OutlierDetection
+	TLS                           *UpstreamTLS
+	LocalityWeighted              bool
+}
+
+type UpstreamTLS struct {
+	SNI                     string
+	CASecret                string
+	SubjectAltNames         []SubjectAltNameMatch
+	ClientCertificateSecret string
+	ALPN                    []string
+}
+
+type SubjectAltNameMatch struct {
+	Type   string
+	Exact  string
+	Prefix string
+	Suffix string
+	Regex  string
+}
+
+type CircuitBreaker struct {
+	Priority           string
+	MaxConnections     *uint32
+	MaxPendingRequests *uint32
+	MaxRequests        *uint32
+	MaxRetries         *uint32
+}
+
+type OutlierDetection struct {
+	Consecutive5xx              *uint32
+	ConsecutiveGatewayFailure   *uint32
+	Interval                    *time.Duration
+	BaseEjectionTime            *time.Duration
+	MaxEjectionPercent          *uint32
+	SuccessRateMinimumHosts     *uint32
+	SuccessRateRequestVolume    *uint32
+	SuccessRateStdevFactor      *uint32
+	EnforcingSuccessRatePercent *uint32
+}
+
+type HealthCheck struct {
+	Type               string
+	Path               string
+	Host               string
+	ExpectedStatuses   []StatusRange
+	ServiceName        string
+	Interval           time.Duration
+	Timeout            time.Duration
+	Jitter             time.Duration
+	HealthyThreshold   uint32
+	UnhealthyThreshold uint32
+}
+
+// StatusRange is an inclusive range of HTTP status codes.
+type StatusRange struct {
+	Start uint32
+	End   uint32
+}
+
+type RetryBudget struct {
+	BudgetPercent       *float64
+	MinRetryConcurrency *uint32
 }
 
 type Endpoint struct {
 	UpstreamHost string
 	UpstreamPort uint32
+	Region       string
+	Zone         string
+	SubZone      string
+	Weight       *uint32
+	Priority     uint32
+	Health       string
 }
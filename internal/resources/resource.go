@@ -15,16 +15,27 @@
 package resources
 
 import (
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/golang/protobuf/ptypes/wrappers"
 
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
 	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	fileaccesslog "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/file/v3"
 	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	tcp "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	upstreamhttp "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
 )
@@ -34,29 +45,380 @@ const (
 	UpstreamPort = 80
 )
 
-func MakeCluster(clusterName string) *cluster.Cluster {
-	return &cluster.Cluster{
-		Name:                 clusterName,
-		ConnectTimeout:       ptypes.DurationProto(5 * time.Second),
-		ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_EDS},
-		LbPolicy:             cluster.Cluster_ROUND_ROBIN,
-		//LoadAssignment:       makeEndpoint(clusterName, UpstreamHost),
-		DnsLookupFamily:  cluster.Cluster_V4_ONLY,
-		EdsClusterConfig: makeEDSCluster(),
+// The protocols a listener can serve.
+const (
+	ProtocolHTTP = "http"
+	ProtocolTCP  = "tcp"
+)
+
+// Defaults for the cluster settings left out of a config.
+const (
+	DefaultConnectTimeout  = 5 * time.Second
+	DefaultClusterType     = "eds"
+	DefaultLbPolicy        = "round_robin"
+	DefaultDNSLookupFamily = "v4_only"
+)
+
+// Defaults for the health check settings left out of a config.
+const (
+	DefaultHealthCheckInterval           = 10 * time.Second
+	DefaultHealthCheckTimeout            = 2 * time.Second
+	DefaultHealthCheckHealthyThreshold   = 2
+	DefaultHealthCheckUnhealthyThreshold = 3
+)
+
+// ClusterTypes maps the cluster discovery types used in configs to Envoy's.
+var ClusterTypes = map[string]cluster.Cluster_DiscoveryType{
+	"eds":         cluster.Cluster_EDS,
+	"static":      cluster.Cluster_STATIC,
+	"strict_dns":  cluster.Cluster_STRICT_DNS,
+	"logical_dns": cluster.Cluster_LOGICAL_DNS,
+}
+
+// IsEDSCluster reports whether a cluster's endpoints are served over EDS,
+// rather than embedded in the cluster.
+func IsEDSCluster(c Cluster) bool {
+	return c.Type == "" || c.Type == DefaultClusterType
+}
+
+// LbPolicies maps the load balancing policy names used in configs to
+// Envoy's policies.
+var LbPolicies = map[string]cluster.Cluster_LbPolicy{
+	"round_robin":   cluster.Cluster_ROUND_ROBIN,
+	"least_request": cluster.Cluster_LEAST_REQUEST,
+	"random":        cluster.Cluster_RANDOM,
+	"ring_hash":     cluster.Cluster_RING_HASH,
+	"maglev":        cluster.Cluster_MAGLEV,
+}
+
+// RoutingPriorities maps the routing priority names used in configs to
+// Envoy's priorities.
+var RoutingPriorities = map[string]core.RoutingPriority{
+	"":        core.RoutingPriority_DEFAULT,
+	"default": core.RoutingPriority_DEFAULT,
+	"high":    core.RoutingPriority_HIGH,
+}
+
+// DNSLookupFamilies maps the DNS lookup family names used in configs to
+// Envoy's lookup families.
+var DNSLookupFamilies = map[string]cluster.Cluster_DnsLookupFamily{
+	"auto":         cluster.Cluster_AUTO,
+	"v4_only":      cluster.Cluster_V4_ONLY,
+	"v6_only":      cluster.Cluster_V6_ONLY,
+	"v4_preferred": cluster.Cluster_V4_PREFERRED,
+	"all":          cluster.Cluster_ALL,
+}
+
+func MakeCluster(c Cluster, cs ConfigSource) *cluster.Cluster {
+	connectTimeout := c.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = DefaultConnectTimeout
+	}
+	lbPolicy := c.LbPolicy
+	if lbPolicy == "" {
+		lbPolicy = DefaultLbPolicy
+	}
+	dnsLookupFamily := c.DNSLookupFamily
+	if dnsLookupFamily == "" {
+		dnsLookupFamily = DefaultDNSLookupFamily
+	}
+
+	clusterType := c.Type
+	if clusterType == "" {
+		clusterType = DefaultClusterType
+	}
+
+	cl := &cluster.Cluster{
+		Name:                 c.Name,
+		ConnectTimeout:       ptypes.DurationProto(connectTimeout),
+		ClusterDiscoveryType: &cluster.Cluster_Type{Type: ClusterTypes[clusterType]},
+		LbPolicy:             LbPolicies[lbPolicy],
+		DnsLookupFamily:      DNSLookupFamilies[dnsLookupFamily],
+		CircuitBreakers:      makeCircuitBreakers(c.CircuitBreakers, c.RetryBudget),
+		OutlierDetection:     makeOutlierDetection(c.OutlierDetection),
+	}
+
+	if IsEDSCluster(c) {
+		cl.EdsClusterConfig = makeEDSCluster(cs)
+	} else {
+		cl.LoadAssignment = MakeEndpoint(c.Name, c.Endpoints)
+		cl.RespectDnsTtl = c.RespectDNSTTL
+		if c.DNSRefreshRate != nil {
+			cl.DnsRefreshRate = ptypes.DurationProto(*c.DNSRefreshRate)
+		}
 	}
+
+	if c.TLS != nil {
+		cl.TransportSocket = makeUpstreamTLSTransportSocket(c.TLS, cs)
+	}
+
+	grpcHealthCheck := false
+	for _, hc := range c.HealthChecks {
+		cl.HealthChecks = append(cl.HealthChecks, makeHealthCheck(hc))
+		grpcHealthCheck = grpcHealthCheck || hc.Type == "grpc"
+	}
+
+	// gRPC health checks need the cluster to speak HTTP/2, or Envoy rejects it
+	if grpcHealthCheck {
+		cl.TypedExtensionProtocolOptions = map[string]*any.Any{
+			httpProtocolOptions: makeHTTP2ProtocolOptions(),
+		}
+	}
+
+	if c.LocalityWeighted {
+		cl.CommonLbConfig = &cluster.Cluster_CommonLbConfig{
+			LocalityConfigSpecifier: &cluster.Cluster_CommonLbConfig_LocalityWeightedLbConfig_{
+				LocalityWeightedLbConfig: &cluster.Cluster_CommonLbConfig_LocalityWeightedLbConfig{},
+			},
+		}
+	}
+
+	if c.PerConnectionBufferLimitBytes != nil {
+		cl.PerConnectionBufferLimitBytes = &wrappers.UInt32Value{Value: *c.PerConnectionBufferLimitBytes}
+	}
+
+	switch cl.LbPolicy {
+	case cluster.Cluster_LEAST_REQUEST:
+		if c.LeastRequestChoiceCount != nil {
+			cl.LbConfig = &cluster.Cluster_LeastRequestLbConfig_{
+				LeastRequestLbConfig: &cluster.Cluster_LeastRequestLbConfig{
+					ChoiceCount: &wrappers.UInt32Value{Value: *c.LeastRequestChoiceCount},
+				},
+			}
+		}
+	case cluster.Cluster_RING_HASH:
+		ringHash := &cluster.Cluster_RingHashLbConfig{}
+		if c.RingHashMinimumSize != nil {
+			ringHash.MinimumRingSize = &wrappers.UInt64Value{Value: *c.RingHashMinimumSize}
+		}
+		if c.RingHashMaximumSize != nil {
+			ringHash.MaximumRingSize = &wrappers.UInt64Value{Value: *c.RingHashMaximumSize}
+		}
+		cl.LbConfig = &cluster.Cluster_RingHashLbConfig_{
+			RingHashLbConfig: ringHash,
+		}
+	case cluster.Cluster_MAGLEV:
+		if c.MaglevTableSize != nil {
+			cl.LbConfig = &cluster.Cluster_MaglevLbConfig_{
+				MaglevLbConfig: &cluster.Cluster_MaglevLbConfig{
+					TableSize: &wrappers.UInt64Value{Value: *c.MaglevTableSize},
+				},
+			}
+		}
+	}
+
+	return cl
 }
 
-func makeEDSCluster() *cluster.Cluster_EdsClusterConfig {
+func makeHealthCheck(hc HealthCheck) *core.HealthCheck {
+	interval := hc.Interval
+	if interval == 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	timeout := hc.Timeout
+	if timeout == 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	healthyThreshold := hc.HealthyThreshold
+	if healthyThreshold == 0 {
+		healthyThreshold = DefaultHealthCheckHealthyThreshold
+	}
+	unhealthyThreshold := hc.UnhealthyThreshold
+	if unhealthyThreshold == 0 {
+		unhealthyThreshold = DefaultHealthCheckUnhealthyThreshold
+	}
+
+	check := &core.HealthCheck{
+		Interval:           ptypes.DurationProto(interval),
+		Timeout:            ptypes.DurationProto(timeout),
+		HealthyThreshold:   &wrappers.UInt32Value{Value: healthyThreshold},
+		UnhealthyThreshold: &wrappers.UInt32Value{Value: unhealthyThreshold},
+	}
+	if hc.Jitter > 0 {
+		check.IntervalJitter = ptypes.DurationProto(hc.Jitter)
+	}
+
+	switch hc.Type {
+	case "http":
+		httpCheck := &core.HealthCheck_HttpHealthCheck{
+			Host: hc.Host,
+			Path: hc.Path,
+		}
+		// Envoy's ranges exclude their end
+		for _, r := range hc.ExpectedStatuses {
+			httpCheck.ExpectedStatuses = append(httpCheck.ExpectedStatuses, &envoytype.Int64Range{
+				Start: int64(r.Start),
+				End:   int64(r.End) + 1,
+			})
+		}
+		check.HealthChecker = &core.HealthCheck_HttpHealthCheck_{
+			HttpHealthCheck: httpCheck,
+		}
+	case "tcp":
+		check.HealthChecker = &core.HealthCheck_TcpHealthCheck_{
+			TcpHealthCheck: &core.HealthCheck_TcpHealthCheck{},
+		}
+	case "grpc":
+		check.HealthChecker = &core.HealthCheck_GrpcHealthCheck_{
+			GrpcHealthCheck: &core.HealthCheck_GrpcHealthCheck{
+				ServiceName: hc.ServiceName,
+				Authority:   hc.Host,
+			},
+		}
+	}
+
+	return check
+}
+
+// httpProtocolOptions is the extension name of a cluster's HTTP protocol options.
+const httpProtocolOptions = "envoy.extensions.upstreams.http.v3.HttpProtocolOptions"
+
+// makeHTTP2ProtocolOptions returns the protocol options of a cluster that
+// is sent HTTP/2.
+func makeHTTP2ProtocolOptions() *any.Any {
+	pbst, err := ptypes.MarshalAny(&upstreamhttp.HttpProtocolOptions{
+		UpstreamProtocolOptions: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_{
+			ExplicitHttpConfig: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig{
+				ProtocolConfig: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_Http2ProtocolOptions{
+					Http2ProtocolOptions: &core.Http2ProtocolOptions{},
+				},
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return pbst
+}
+
+// makeCircuitBreakers sets the thresholds of each routing priority. The
+// retry budget applies to the default priority.
+func makeCircuitBreakers(breakers []CircuitBreaker, rb *RetryBudget) *cluster.CircuitBreakers {
+	if len(breakers) == 0 && rb == nil {
+		return nil
+	}
+
+	var thresholds []*cluster.CircuitBreakers_Thresholds
+	var defaultThresholds *cluster.CircuitBreakers_Thresholds
+	for _, b := range breakers {
+		t := &cluster.CircuitBreakers_Thresholds{
+			Priority:           RoutingPriorities[b.Priority],
+			MaxConnections:     uint32Value(b.MaxConnections),
+			MaxPendingRequests: uint32Value(b.MaxPendingRequests),
+			MaxRequests:        uint32Value(b.MaxRequests),
+			MaxRetries:         uint32Value(b.MaxRetries),
+		}
+		if t.Priority == core.RoutingPriority_DEFAULT {
+			defaultThresholds = t
+		}
+		thresholds = append(thresholds, t)
+	}
+
+	if rb != nil {
+		if defaultThresholds == nil {
+			defaultThresholds = &cluster.CircuitBreakers_Thresholds{
+				Priority: core.RoutingPriority_DEFAULT,
+			}
+			thresholds = append(thresholds, defaultThresholds)
+		}
+
+		defaultThresholds.RetryBudget = &cluster.CircuitBreakers_Thresholds_RetryBudget{
+			MinRetryConcurrency: uint32Value(rb.MinRetryConcurrency),
+		}
+		if rb.BudgetPercent != nil {
+			defaultThresholds.RetryBudget.BudgetPercent = &envoytype.Percent{Value: *rb.BudgetPercent}
+		}
+	}
+
+	return &cluster.CircuitBreakers{
+		Thresholds: thresholds,
+	}
+}
+
+func makeOutlierDetection(od *OutlierDetection) *cluster.OutlierDetection {
+	if od == nil {
+		return nil
+	}
+
+	detection := &cluster.OutlierDetection{
+		Consecutive_5Xx:           uint32Value(od.Consecutive5xx),
+		ConsecutiveGatewayFailure: uint32Value(od.ConsecutiveGatewayFailure),
+		MaxEjectionPercent:        uint32Value(od.MaxEjectionPercent),
+		SuccessRateMinimumHosts:   uint32Value(od.SuccessRateMinimumHosts),
+		SuccessRateRequestVolume:  uint32Value(od.SuccessRateRequestVolume),
+		SuccessRateStdevFactor:    uint32Value(od.SuccessRateStdevFactor),
+		EnforcingSuccessRate:      uint32Value(od.EnforcingSuccessRatePercent),
+	}
+
+	// Envoy only counts gateway failures unless told to enforce them
+	if od.ConsecutiveGatewayFailure != nil {
+		detection.EnforcingConsecutiveGatewayFailure = &wrappers.UInt32Value{Value: 100}
+	}
+	if od.Interval != nil {
+		detection.Interval = ptypes.DurationProto(*od.Interval)
+	}
+	if od.BaseEjectionTime != nil {
+		detection.BaseEjectionTime = ptypes.DurationProto(*od.BaseEjectionTime)
+	}
+
+	return detection
+}
+
+// uint32Value wraps an optional value, leaving it unset when nil.
+func uint32Value(v *uint32) *wrappers.UInt32Value {
+	if v == nil {
+		return nil
+	}
+	return &wrappers.UInt32Value{Value: *v}
+}
+
+func makeEDSCluster(cs ConfigSource) *cluster.Cluster_EdsClusterConfig {
 	return &cluster.Cluster_EdsClusterConfig{
-		EdsConfig: makeConfigSource(),
+		EdsConfig: makeConfigSource(cs),
 	}
 }
 
+// HealthStatuses maps the endpoint health statuses used in configs to
+// Envoy's.
+var HealthStatuses = map[string]core.HealthStatus{
+	"":          core.HealthStatus_UNKNOWN,
+	"healthy":   core.HealthStatus_HEALTHY,
+	"draining":  core.HealthStatus_DRAINING,
+	"unhealthy": core.HealthStatus_UNHEALTHY,
+	"degraded":  core.HealthStatus_DEGRADED,
+}
+
+// MakeEndpoint groups the endpoints of a cluster by locality and priority.
+// The weight of a locality is the sum of the weights of its endpoints.
 func MakeEndpoint(clusterName string, eps []Endpoint) *endpoint.ClusterLoadAssignment {
-	var endpoints []*endpoint.LbEndpoint
+	type localityKey struct {
+		region, zone, subZone string
+		priority              uint32
+	}
+
+	var localities []*endpoint.LocalityLbEndpoints
+	index := make(map[localityKey]*endpoint.LocalityLbEndpoints)
 
 	for _, e := range eps {
-		endpoints = append(endpoints, &endpoint.LbEndpoint{
+		key := localityKey{e.Region, e.Zone, e.SubZone, e.Priority}
+		locality, ok := index[key]
+		if !ok {
+			locality = &endpoint.LocalityLbEndpoints{
+				Priority:            e.Priority,
+				LoadBalancingWeight: &wrappers.UInt32Value{},
+			}
+			if e.Region != "" || e.Zone != "" || e.SubZone != "" {
+				locality.Locality = &core.Locality{
+					Region:  e.Region,
+					Zone:    e.Zone,
+					SubZone: e.SubZone,
+				}
+			}
+			index[key] = locality
+			localities = append(localities, locality)
+		}
+
+		lbEndpoint := &endpoint.LbEndpoint{
 			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
 				Endpoint: &endpoint.Endpoint{
 					Address: &core.Address{
@@ -72,103 +434,475 @@ func MakeEndpoint(clusterName string, eps []Endpoint) *endpoint.ClusterLoadAssig
 					},
 				},
 			},
-		})
+			HealthStatus: HealthStatuses[e.Health],
+		}
+
+		weight := uint32(1)
+		if e.Weight != nil {
+			weight = *e.Weight
+			lbEndpoint.LoadBalancingWeight = &wrappers.UInt32Value{Value: weight}
+		}
+		locality.LoadBalancingWeight.Value += weight
+		locality.LbEndpoints = append(locality.LbEndpoints, lbEndpoint)
 	}
 
+	// Keep the localities in priority order, each priority in the order its
+	// localities first appear.
+	sort.SliceStable(localities, func(i, j int) bool {
+		return localities[i].Priority < localities[j].Priority
+	})
+
 	return &endpoint.ClusterLoadAssignment{
 		ClusterName: clusterName,
-		Endpoints: []*endpoint.LocalityLbEndpoints{{
-			LbEndpoints: endpoints,
-		}},
+		Endpoints:   localities,
 	}
 }
 
-func MakeRoute(routes []Route) *route.RouteConfiguration {
+func MakeRoute(routeConfigName string, virtualHosts []VirtualHost) *route.RouteConfiguration {
+	var vhosts []*route.VirtualHost
+
+	for _, vh := range virtualHosts {
+		vhosts = append(vhosts, &route.VirtualHost{
+			Name:        vh.Name,
+			Domains:     vh.Domains,
+			Routes:      makeRoutes(vh.Routes),
+			RetryPolicy: makeRetryPolicy(vh.RetryPolicy),
+		})
+	}
+
+	return &route.RouteConfiguration{
+		Name:         routeConfigName,
+		VirtualHosts: vhosts,
+	}
+}
+
+func makeRoutes(routes []Route) []*route.Route {
 	var rts []*route.Route
 
 	for _, r := range routes {
-		rts = append(rts, &route.Route{
+		rt := &route.Route{
 			//Name: r.Name,
-			Match: &route.RouteMatch{
-				PathSpecifier: &route.RouteMatch_Prefix{
-					Prefix: r.Prefix,
-				},
+			Match: makeRouteMatch(r.Match),
+		}
+
+		switch {
+		case r.Redirect != nil:
+			rt.Action = &route.Route_Redirect{
+				Redirect: makeRedirectAction(r.Redirect),
+			}
+		case r.DirectResponse != nil:
+			rt.Action = &route.Route_DirectResponse{
+				DirectResponse: makeDirectResponseAction(r.DirectResponse),
+			}
+		default:
+			action := makeRouteAction(r.Clusters, r.Rewrite)
+			if r.Timeout != nil {
+				action.Timeout = ptypes.DurationProto(*r.Timeout)
+			}
+			if r.IdleTimeout != nil {
+				action.IdleTimeout = ptypes.DurationProto(*r.IdleTimeout)
+			}
+			action.RetryPolicy = makeRetryPolicy(r.RetryPolicy)
+
+			rt.Action = &route.Route_Route{
+				Route: action,
+			}
+		}
+
+		rts = append(rts, rt)
+	}
+
+	return rts
+}
+
+func makeRouteMatch(m RouteMatch) *route.RouteMatch {
+	match := &route.RouteMatch{}
+
+	switch {
+	case m.Path != "":
+		match.PathSpecifier = &route.RouteMatch_Path{
+			Path: m.Path,
+		}
+	case m.Regex != "":
+		match.PathSpecifier = &route.RouteMatch_SafeRegex{
+			SafeRegex: &matcher.RegexMatcher{Regex: m.Regex},
+		}
+	case m.PathSeparatedPrefix != "":
+		match.PathSpecifier = &route.RouteMatch_PathSeparatedPrefix{
+			PathSeparatedPrefix: m.PathSeparatedPrefix,
+		}
+	default:
+		match.PathSpecifier = &route.RouteMatch_Prefix{
+			Prefix: m.Prefix,
+		}
+	}
+
+	if m.CaseSensitive != nil {
+		match.CaseSensitive = &wrappers.BoolValue{Value: *m.CaseSensitive}
+	}
+
+	// Methods are matched on the :method pseudo-header
+	if len(m.Methods) > 0 {
+		var methods []string
+		for _, method := range m.Methods {
+			methods = append(methods, regexp.QuoteMeta(method))
+		}
+		match.Headers = append(match.Headers, makeHeaderMatcher(HeaderMatch{
+			Name:  ":method",
+			Regex: strings.Join(methods, "|"),
+		}))
+	}
+
+	for _, h := range m.Headers {
+		match.Headers = append(match.Headers, makeHeaderMatcher(h))
+	}
+
+	for _, q := range m.QueryParams {
+		qm := &route.QueryParameterMatcher{
+			Name: q.Name,
+		}
+		if sm := makeStringMatcher(q.Exact, q.Regex); sm != nil {
+			qm.QueryParameterMatchSpecifier = &route.QueryParameterMatcher_StringMatch{
+				StringMatch: sm,
+			}
+		} else {
+			qm.QueryParameterMatchSpecifier = &route.QueryParameterMatcher_PresentMatch{
+				PresentMatch: true,
+			}
+		}
+		match.QueryParameters = append(match.QueryParameters, qm)
+	}
+
+	return match
+}
+
+func makeHeaderMatcher(h HeaderMatch) *route.HeaderMatcher {
+	hm := &route.HeaderMatcher{
+		Name:        h.Name,
+		InvertMatch: h.Invert,
+	}
+	if sm := makeStringMatcher(h.Exact, h.Regex); sm != nil {
+		hm.HeaderMatchSpecifier = &route.HeaderMatcher_StringMatch{
+			StringMatch: sm,
+		}
+	} else {
+		hm.HeaderMatchSpecifier = &route.HeaderMatcher_PresentMatch{
+			PresentMatch: true,
+		}
+	}
+	return hm
+}
+
+// makeStringMatcher matches an exact value or a regex, and returns nil
+// when neither is given.
+func makeStringMatcher(exact, regex string) *matcher.StringMatcher {
+	switch {
+	case exact != "":
+		return &matcher.StringMatcher{
+			MatchPattern: &matcher.StringMatcher_Exact{Exact: exact},
+		}
+	case regex != "":
+		return &matcher.StringMatcher{
+			MatchPattern: &matcher.StringMatcher_SafeRegex{
+				SafeRegex: &matcher.RegexMatcher{Regex: regex},
 			},
-			Action: &route.Route_Route{
-				Route: &route.RouteAction{
-					ClusterSpecifier: &route.RouteAction_Cluster{
-						Cluster: r.Cluster,
-					},
-				},
+		}
+	}
+	return nil
+}
+
+func makeRetryPolicy(rp *RetryPolicy) *route.RetryPolicy {
+	if rp == nil {
+		return nil
+	}
+
+	policy := &route.RetryPolicy{
+		RetryOn:              strings.Join(rp.RetryOn, ","),
+		RetriableStatusCodes: rp.RetriableStatusCodes,
+	}
+
+	if rp.NumRetries != nil {
+		policy.NumRetries = &wrappers.UInt32Value{Value: *rp.NumRetries}
+	}
+	if rp.PerTryTimeout != nil {
+		policy.PerTryTimeout = ptypes.DurationProto(*rp.PerTryTimeout)
+	}
+	if rp.BaseInterval > 0 {
+		policy.RetryBackOff = &route.RetryPolicy_RetryBackOff{
+			BaseInterval: ptypes.DurationProto(rp.BaseInterval),
+		}
+		if rp.MaxInterval > 0 {
+			policy.RetryBackOff.MaxInterval = ptypes.DurationProto(rp.MaxInterval)
+		}
+	}
+
+	return policy
+}
+
+// redirectResponseCodes maps HTTP status codes to Envoy's redirect codes.
+var redirectResponseCodes = map[uint32]route.RedirectAction_RedirectResponseCode{
+	301: route.RedirectAction_MOVED_PERMANENTLY,
+	302: route.RedirectAction_FOUND,
+	303: route.RedirectAction_SEE_OTHER,
+	307: route.RedirectAction_TEMPORARY_REDIRECT,
+	308: route.RedirectAction_PERMANENT_REDIRECT,
+}
+
+func makeRedirectAction(rd *Redirect) *route.RedirectAction {
+	action := &route.RedirectAction{
+		HostRedirect: rd.Host,
+		PortRedirect: rd.Port,
+		ResponseCode: redirectResponseCodes[rd.ResponseCode],
+		StripQuery:   rd.StripQuery,
+	}
+
+	if rd.Scheme != "" {
+		action.SchemeRewriteSpecifier = &route.RedirectAction_SchemeRedirect{
+			SchemeRedirect: rd.Scheme,
+		}
+	}
+
+	switch {
+	case rd.Path != "":
+		action.PathRewriteSpecifier = &route.RedirectAction_PathRedirect{
+			PathRedirect: rd.Path,
+		}
+	case rd.PrefixRewrite != "":
+		action.PathRewriteSpecifier = &route.RedirectAction_PrefixRewrite{
+			PrefixRewrite: rd.PrefixRewrite,
+		}
+	}
+
+	return action
+}
+
+func makeDirectResponseAction(dr *DirectResponse) *route.DirectResponseAction {
+	action := &route.DirectResponseAction{
+		Status: dr.Status,
+	}
+
+	if dr.Body != "" {
+		action.Body = &core.DataSource{
+			Specifier: &core.DataSource_InlineString{
+				InlineString: dr.Body,
 			},
+		}
+	}
+
+	return action
+}
+
+// makeRouteAction sends traffic to a single cluster, or splits it across
+// several clusters in proportion to their weights, rewriting the request
+// on the way.
+func makeRouteAction(clusters []WeightedCluster, rewrite Rewrite) *route.RouteAction {
+	action := &route.RouteAction{
+		PrefixRewrite: rewrite.Prefix,
+	}
+
+	if rewrite.RegexPattern != "" {
+		action.RegexRewrite = &matcher.RegexMatchAndSubstitute{
+			Pattern:      &matcher.RegexMatcher{Regex: rewrite.RegexPattern},
+			Substitution: rewrite.RegexSubstitution,
+		}
+	}
+
+	if rewrite.Host != "" {
+		action.HostRewriteSpecifier = &route.RouteAction_HostRewriteLiteral{
+			HostRewriteLiteral: rewrite.Host,
+		}
+	}
+
+	if len(clusters) == 1 {
+		action.ClusterSpecifier = &route.RouteAction_Cluster{
+			Cluster: clusters[0].Name,
+		}
+		return action
+	}
+
+	var weighted []*route.WeightedCluster_ClusterWeight
+	var total uint32
+	for _, c := range clusters {
+		weighted = append(weighted, &route.WeightedCluster_ClusterWeight{
+			Name:   c.Name,
+			Weight: &wrappers.UInt32Value{Value: c.Weight},
 		})
+		total += c.Weight
 	}
 
-	return &route.RouteConfiguration{
-		Name: "listener_0",
-		VirtualHosts: []*route.VirtualHost{{
-			Name:    "local_service",
-			Domains: []string{"*"},
-			Routes:  rts,
-		}},
+	action.ClusterSpecifier = &route.RouteAction_WeightedClusters{
+		WeightedClusters: &route.WeightedCluster{
+			Clusters:    weighted,
+			TotalWeight: &wrappers.UInt32Value{Value: total},
+		},
 	}
+	return action
 }
 
-func MakeHTTPListener(listenerName, route, address string, port uint32) *listener.Listener {
+func MakeHTTPListener(l Listener, cs ConfigSource) *listener.Listener {
 	// HTTP filter configuration
 	manager := &hcm.HttpConnectionManager{
 		CodecType:  hcm.HttpConnectionManager_AUTO,
 		StatPrefix: "http",
 		RouteSpecifier: &hcm.HttpConnectionManager_Rds{
 			Rds: &hcm.Rds{
-				ConfigSource:    makeConfigSource(),
-				RouteConfigName: "listener_0",
+				ConfigSource:    makeConfigSource(cs),
+				RouteConfigName: l.RouteConfigName,
 			},
 		},
 		HttpFilters: []*hcm.HttpFilter{{
 			Name: wellknown.Router,
 		}},
+		AccessLog: makeAccessLog(l.AccessLog),
 	}
 	pbst, err := ptypes.MarshalAny(manager)
 	if err != nil {
 		panic(err)
 	}
 
+	return makeListener(l, cs, &listener.Filter{
+		Name: wellknown.HTTPConnectionManager,
+		ConfigType: &listener.Filter_TypedConfig{
+			TypedConfig: pbst,
+		},
+	})
+}
+
+// MakeTCPListener returns a listener that proxies connections to one
+// cluster, or across weighted clusters.
+func MakeTCPListener(l Listener, cs ConfigSource) *listener.Listener {
+	proxy := &tcp.TcpProxy{
+		StatPrefix: l.Name,
+		AccessLog:  makeAccessLog(l.AccessLog),
+	}
+
+	if len(l.Clusters) == 1 {
+		proxy.ClusterSpecifier = &tcp.TcpProxy_Cluster{
+			Cluster: l.Clusters[0].Name,
+		}
+	} else {
+		var weighted []*tcp.TcpProxy_WeightedCluster_ClusterWeight
+		for _, c := range l.Clusters {
+			weighted = append(weighted, &tcp.TcpProxy_WeightedCluster_ClusterWeight{
+				Name:   c.Name,
+				Weight: c.Weight,
+			})
+		}
+		proxy.ClusterSpecifier = &tcp.TcpProxy_WeightedClusters{
+			WeightedClusters: &tcp.TcpProxy_WeightedCluster{
+				Clusters: weighted,
+			},
+		}
+	}
+
+	if l.IdleTimeout != nil {
+		proxy.IdleTimeout = ptypes.DurationProto(*l.IdleTimeout)
+	}
+
+	pbst, err := ptypes.MarshalAny(proxy)
+	if err != nil {
+		panic(err)
+	}
+
+	return makeListener(l, cs, &listener.Filter{
+		Name: wellknown.TCPProxy,
+		ConfigType: &listener.Filter_TypedConfig{
+			TypedConfig: pbst,
+		},
+	})
+}
+
+// makeAccessLog returns an access log writing to path, if it is set.
+func makeAccessLog(path string) []*accesslog.AccessLog {
+	if path == "" {
+		return nil
+	}
+
+	pbst, err := ptypes.MarshalAny(&fileaccesslog.FileAccessLog{
+		Path: path,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return []*accesslog.AccessLog{{
+		Name: wellknown.FileAccessLog,
+		ConfigType: &accesslog.AccessLog_TypedConfig{
+			TypedConfig: pbst,
+		},
+	}}
+}
+
+// makeListener returns a listener with a single filter chain running filter.
+func makeListener(l Listener, cs ConfigSource, filter *listener.Filter) *listener.Listener {
+	filterChain := &listener.FilterChain{
+		Filters: []*listener.Filter{filter},
+	}
+	if l.TLS != nil {
+		filterChain.TransportSocket = makeDownstreamTLSTransportSocket(l.TLS, cs)
+	}
+
 	return &listener.Listener{
-		Name: listenerName,
+		Name: l.Name,
 		Address: &core.Address{
 			Address: &core.Address_SocketAddress{
 				SocketAddress: &core.SocketAddress{
 					Protocol: core.SocketAddress_TCP,
-					Address:  address,
+					Address:  l.Address,
 					PortSpecifier: &core.SocketAddress_PortValue{
-						PortValue: port,
+						PortValue: l.Port,
 					},
 				},
 			},
 		},
-		FilterChains: []*listener.FilterChain{{
-			Filters: []*listener.Filter{{
-				Name: wellknown.HTTPConnectionManager,
-				ConfigType: &listener.Filter_TypedConfig{
-					TypedConfig: pbst,
-				},
-			}},
-		}},
+		FilterChains: []*listener.FilterChain{filterChain},
 	}
 }
 
-func makeConfigSource() *core.ConfigSource {
+// DefaultXDSCluster is the name of the Envoy cluster that this server is
+// reached through, when a config source does not name one.
+const DefaultXDSCluster = "xds_cluster"
+
+// ConfigSource selects how Envoy fetches the resources that others refer
+// to, such as a listener's routes or a cluster's endpoints. With ADS they
+// are fetched over the aggregated stream Envoy's bootstrap set up, and
+// otherwise over a stream per type to ClusterName. With Delta those streams
+// use the incremental xDS protocol, so only the resources that changed are
+// sent.
+type ConfigSource struct {
+	ADS         bool
+	Delta       bool
+	ClusterName string
+}
+
+func makeConfigSource(cs ConfigSource) *core.ConfigSource {
 	source := &core.ConfigSource{}
 	source.ResourceApiVersion = resource.DefaultAPIVersion
+
+	if cs.ADS {
+		source.ConfigSourceSpecifier = &core.ConfigSource_Ads{
+			Ads: &core.AggregatedConfigSource{},
+		}
+		return source
+	}
+
+	apiType := core.ApiConfigSource_GRPC
+	if cs.Delta {
+		apiType = core.ApiConfigSource_DELTA_GRPC
+	}
+	clusterName := cs.ClusterName
+	if clusterName == "" {
+		clusterName = DefaultXDSCluster
+	}
+
 	source.ConfigSourceSpecifier = &core.ConfigSource_ApiConfigSource{
 		ApiConfigSource: &core.ApiConfigSource{
 			TransportApiVersion:       resource.DefaultAPIVersion,
-			ApiType:                   core.ApiConfigSource_GRPC,
+			ApiType:                   apiType,
 			SetNodeOnFirstMessageOnly: true,
 			GrpcServices: []*core.GrpcService{{
 				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
-					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: "xds_cluster"},
+					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: clusterName},
 				},
 			}},
 		},
@@ -0,0 +1,48 @@
+//   Copyright Steve Sloka 2021
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package resources
+
+import (
+	"testing"
+
+	upstreamhttp "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
+)
+
+func TestMakeClusterGRPCHealthCheck(t *testing.T) {
+	c := MakeCluster(Cluster{
+		Name:         "api",
+		HealthChecks: []HealthCheck{{Type: "grpc", ServiceName: "api.v1.Api"}},
+	}, ConfigSource{ClusterName: DefaultXDSCluster})
+
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var options upstreamhttp.HttpProtocolOptions
+	if err := c.TypedExtensionProtocolOptions[httpProtocolOptions].UnmarshalTo(&options); err != nil {
+		t.Fatalf("cluster has no HTTP protocol options: %v", err)
+	}
+	if options.GetExplicitHttpConfig().GetHttp2ProtocolOptions() == nil {
+		t.Errorf("cluster with a grpc health check is not sent HTTP/2: %v", &options)
+	}
+
+	c = MakeCluster(Cluster{
+		Name:         "web",
+		HealthChecks: []HealthCheck{{Type: "http", Path: "/healthz"}},
+	}, ConfigSource{ClusterName: DefaultXDSCluster})
+	if c.TypedExtensionProtocolOptions != nil {
+		t.Errorf("cluster without a grpc health check has protocol options: %v", c.TypedExtensionProtocolOptions)
+	}
+}
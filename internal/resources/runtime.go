@@ -0,0 +1,71 @@
+//   Copyright Steve Sloka 2021
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package resources
+
+import (
+	_struct "github.com/golang/protobuf/ptypes/struct"
+
+	runtime "github.com/envoyproxy/go-control-plane/envoy/service/runtime/v3"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+// FractionDenominators maps the denominators used in configs to Envoy's.
+var FractionDenominators = map[string]envoytype.FractionalPercent_DenominatorType{
+	"":             envoytype.FractionalPercent_HUNDRED,
+	"hundred":      envoytype.FractionalPercent_HUNDRED,
+	"ten_thousand": envoytype.FractionalPercent_TEN_THOUSAND,
+	"million":      envoytype.FractionalPercent_MILLION,
+}
+
+// MakeRuntime returns the RTDS resource for a runtime layer. Fractional
+// percentages are written as the numerator and denominator fields Envoy
+// reads them from.
+func MakeRuntime(l RuntimeLayer) *runtime.Runtime {
+	layer := &_struct.Struct{Fields: make(map[string]*_struct.Value)}
+
+	for key, value := range l.Values {
+		layer.Fields[key] = makeRuntimeValue(value)
+	}
+
+	for key, fp := range l.FractionalPercents {
+		layer.Fields[key] = &_struct.Value{
+			Kind: &_struct.Value_StructValue{
+				StructValue: &_struct.Struct{
+					Fields: map[string]*_struct.Value{
+						"numerator":   makeRuntimeValue(float64(fp.Numerator)),
+						"denominator": makeRuntimeValue(FractionDenominators[fp.Denominator].String()),
+					},
+				},
+			},
+		}
+	}
+
+	return &runtime.Runtime{
+		Name:  l.Name,
+		Layer: layer,
+	}
+}
+
+func makeRuntimeValue(value interface{}) *_struct.Value {
+	switch v := value.(type) {
+	case bool:
+		return &_struct.Value{Kind: &_struct.Value_BoolValue{BoolValue: v}}
+	case float64:
+		return &_struct.Value{Kind: &_struct.Value_NumberValue{NumberValue: v}}
+	case string:
+		return &_struct.Value{Kind: &_struct.Value_StringValue{StringValue: v}}
+	}
+	return &_struct.Value{Kind: &_struct.Value_NullValue{}}
+}
@@ -0,0 +1,176 @@
+//   Copyright Steve Sloka 2021
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package resources
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+// SubjectAltNameTypes maps the subject alternative name types used in
+// configs to Envoy's types.
+var SubjectAltNameTypes = map[string]tls.SubjectAltNameMatcher_SanType{
+	"":           tls.SubjectAltNameMatcher_DNS,
+	"dns":        tls.SubjectAltNameMatcher_DNS,
+	"uri":        tls.SubjectAltNameMatcher_URI,
+	"email":      tls.SubjectAltNameMatcher_EMAIL,
+	"ip_address": tls.SubjectAltNameMatcher_IP_ADDRESS,
+}
+
+// TLSVersions maps the TLS versions used in configs to Envoy's versions.
+var TLSVersions = map[string]tls.TlsParameters_TlsProtocol{
+	"1.0": tls.TlsParameters_TLSv1_0,
+	"1.1": tls.TlsParameters_TLSv1_1,
+	"1.2": tls.TlsParameters_TLSv1_2,
+	"1.3": tls.TlsParameters_TLSv1_3,
+}
+
+// MakeSecret returns the SDS resource for a secret.
+func MakeSecret(s Secret) *tls.Secret {
+	if len(s.TrustedCA) > 0 {
+		return &tls.Secret{
+			Name: s.Name,
+			Type: &tls.Secret_ValidationContext{
+				ValidationContext: &tls.CertificateValidationContext{
+					TrustedCa: makeInlineBytes(s.TrustedCA),
+				},
+			},
+		}
+	}
+
+	return &tls.Secret{
+		Name: s.Name,
+		Type: &tls.Secret_TlsCertificate{
+			TlsCertificate: &tls.TlsCertificate{
+				CertificateChain: makeInlineBytes(s.CertificateChain),
+				PrivateKey:       makeInlineBytes(s.PrivateKey),
+			},
+		},
+	}
+}
+
+func makeInlineBytes(b []byte) *core.DataSource {
+	return &core.DataSource{
+		Specifier: &core.DataSource_InlineBytes{InlineBytes: b},
+	}
+}
+
+// makeDownstreamTLSTransportSocket terminates TLS on a listener, fetching
+// the certificates it uses from SDS.
+func makeDownstreamTLSTransportSocket(t *DownstreamTLS, cs ConfigSource) *core.TransportSocket {
+	common := &tls.CommonTlsContext{
+		AlpnProtocols: t.ALPN,
+		TlsParams: &tls.TlsParameters{
+			TlsMinimumProtocolVersion: TLSVersions[t.MinVersion],
+			TlsMaximumProtocolVersion: TLSVersions[t.MaxVersion],
+			CipherSuites:              t.CipherSuites,
+		},
+	}
+
+	for _, name := range t.CertificateSecrets {
+		common.TlsCertificateSdsSecretConfigs = append(common.TlsCertificateSdsSecretConfigs, makeSdsSecretConfig(name, cs))
+	}
+
+	if t.ClientCASecret != "" {
+		common.ValidationContextType = &tls.CommonTlsContext_ValidationContextSdsSecretConfig{
+			ValidationContextSdsSecretConfig: makeSdsSecretConfig(t.ClientCASecret, cs),
+		}
+	}
+
+	return makeTLSTransportSocket(&tls.DownstreamTlsContext{
+		CommonTlsContext:         common,
+		RequireClientCertificate: &wrappers.BoolValue{Value: t.RequireClientCertificate},
+	})
+}
+
+// makeUpstreamTLSTransportSocket connects to a cluster over TLS, fetching
+// the certificates it uses from SDS.
+func makeUpstreamTLSTransportSocket(t *UpstreamTLS, cs ConfigSource) *core.TransportSocket {
+	common := &tls.CommonTlsContext{
+		AlpnProtocols: t.ALPN,
+	}
+
+	if t.ClientCertificateSecret != "" {
+		common.TlsCertificateSdsSecretConfigs = []*tls.SdsSecretConfig{
+			makeSdsSecretConfig(t.ClientCertificateSecret, cs),
+		}
+	}
+
+	if t.CASecret != "" {
+		var sans []*tls.SubjectAltNameMatcher
+		for _, san := range t.SubjectAltNames {
+			sans = append(sans, &tls.SubjectAltNameMatcher{
+				SanType: SubjectAltNameTypes[san.Type],
+				Matcher: makeSubjectAltNameMatcher(san),
+			})
+		}
+
+		common.ValidationContextType = &tls.CommonTlsContext_CombinedValidationContext{
+			CombinedValidationContext: &tls.CommonTlsContext_CombinedCertificateValidationContext{
+				DefaultValidationContext: &tls.CertificateValidationContext{
+					MatchTypedSubjectAltNames: sans,
+				},
+				ValidationContextSdsSecretConfig: makeSdsSecretConfig(t.CASecret, cs),
+			},
+		}
+	}
+
+	return makeTLSTransportSocket(&tls.UpstreamTlsContext{
+		CommonTlsContext: common,
+		Sni:              t.SNI,
+	})
+}
+
+func makeSubjectAltNameMatcher(san SubjectAltNameMatch) *matcher.StringMatcher {
+	switch {
+	case san.Prefix != "":
+		return &matcher.StringMatcher{
+			MatchPattern: &matcher.StringMatcher_Prefix{Prefix: san.Prefix},
+		}
+	case san.Suffix != "":
+		return &matcher.StringMatcher{
+			MatchPattern: &matcher.StringMatcher_Suffix{Suffix: san.Suffix},
+		}
+	}
+	return makeStringMatcher(san.Exact, san.Regex)
+}
+
+// makeSdsSecretConfig references a secret served by this xDS server.
+func makeSdsSecretConfig(name string, cs ConfigSource) *tls.SdsSecretConfig {
+	return &tls.SdsSecretConfig{
+		Name:      name,
+		SdsConfig: makeConfigSource(cs),
+	}
+}
+
+func makeTLSTransportSocket(context proto.Message) *core.TransportSocket {
+	pbst, err := ptypes.MarshalAny(context)
+	if err != nil {
+		panic(err)
+	}
+
+	return &core.TransportSocket{
+		Name: wellknown.TransportSocketTls,
+		ConfigType: &core.TransportSocket_TypedConfig{
+			TypedConfig: pbst,
+		},
+	}
+}
@@ -0,0 +1,331 @@
+//   Copyright Steve Sloka 2021
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/stevesloka/envoy-xds-server/internal/metrics"
+)
+
+// Callbacks logs the lifecycle of xDS streams: streams opening and closing,
+// the requests Envoy sends and the responses it is sent. Requests that
+// reject a response (NACKs) are logged as errors, along with Envoy's error
+// and the names of the resources in the rejected response.
+type Callbacks struct {
+	logrus.FieldLogger
+
+	// cache and nodeHash look up the resources of rejected responses.
+	cache    cache.SnapshotCache
+	nodeHash cache.NodeHash
+
+	mu sync.Mutex
+	// streams holds the state of open state-of-the-world streams by ID.
+	streams map[int64]*stream
+	// deltaStreams holds the state of open delta streams by ID, which are
+	// numbered separately.
+	deltaStreams map[int64]*stream
+}
+
+var _ serverv3.Callbacks = &Callbacks{}
+
+// stream holds what is known about an open stream.
+type stream struct {
+	// typeURL is the type of the stream, counted in the streams metric.
+	typeURL string
+	// node is the Envoy node, sent with the first request of a stream.
+	node *core.Node
+	// sent holds the last response sent on the stream, by type URL.
+	sent map[string]sentResponse
+}
+
+// sentResponse records a response, to report the resources in it if it is
+// rejected.
+type sentResponse struct {
+	version string
+	nonce   string
+	// requested holds the resource names a state-of-the-world response was
+	// sent for, or none if it holds every resource of its type. The
+	// resources are looked up in the cache if the response is rejected.
+	requested []string
+	// names holds the names of the resources of a delta response.
+	names []string
+}
+
+// NewCallbacks returns Callbacks logging to log, which look up the
+// resources of rejected responses in snapshots, keyed by nodeHash.
+func NewCallbacks(log logrus.FieldLogger, snapshots cache.SnapshotCache, nodeHash cache.NodeHash) *Callbacks {
+	return &Callbacks{
+		FieldLogger:  log,
+		cache:        snapshots,
+		nodeHash:     nodeHash,
+		streams:      make(map[int64]*stream),
+		deltaStreams: make(map[int64]*stream),
+	}
+}
+
+// OnStreamOpen implements serverv3.Callbacks.
+func (c *Callbacks) OnStreamOpen(_ context.Context, id int64, typeURL string) error {
+	c.mu.Lock()
+	c.streams[id] = &stream{typeURL: streamType(typeURL), sent: make(map[string]sentResponse)}
+	c.mu.Unlock()
+
+	metrics.Streams.WithLabelValues(streamType(typeURL)).Inc()
+	c.WithFields(logrus.Fields{"stream": id, "type": streamType(typeURL)}).Info("stream opened")
+	return nil
+}
+
+// OnStreamClosed implements serverv3.Callbacks.
+func (c *Callbacks) OnStreamClosed(id int64) {
+	c.mu.Lock()
+	s := c.streams[id]
+	delete(c.streams, id)
+	c.mu.Unlock()
+
+	if s != nil {
+		metrics.Streams.WithLabelValues(s.typeURL).Dec()
+	}
+	c.WithFields(logrus.Fields{"stream": id, "node": nodeID(s)}).Info("stream closed")
+}
+
+// OnStreamRequest implements serverv3.Callbacks.
+func (c *Callbacks) OnStreamRequest(id int64, req *discovery.DiscoveryRequest) error {
+	c.mu.Lock()
+	s := c.track(c.streams, id, req.Node)
+	node := s.node
+	last := s.sent[req.TypeUrl]
+	c.mu.Unlock()
+
+	log := c.WithFields(logrus.Fields{
+		"stream":  id,
+		"node":    nodeID(s),
+		"type":    req.TypeUrl,
+		"version": req.VersionInfo,
+		"nonce":   req.ResponseNonce,
+	})
+
+	switch {
+	case req.ErrorDetail != nil:
+		metrics.NACKs.WithLabelValues(nodeID(s)).Inc()
+		if last.nonce == req.ResponseNonce {
+			last.names = c.sentNames(node, req.TypeUrl, last)
+		}
+		c.logNACK(log, last, req.ResponseNonce, req.ErrorDetail.Code, req.ErrorDetail.Message)
+	case req.ResponseNonce != "":
+		metrics.ACKs.WithLabelValues(nodeID(s)).Inc()
+		log.Debug("ACK")
+	default:
+		log.WithField("resources", req.ResourceNames).Debug("request")
+	}
+	return nil
+}
+
+// OnStreamResponse implements serverv3.Callbacks.
+func (c *Callbacks) OnStreamResponse(_ context.Context, id int64, req *discovery.DiscoveryRequest, resp *discovery.DiscoveryResponse) {
+	c.mu.Lock()
+	s := c.track(c.streams, id, nil)
+	s.sent[resp.TypeUrl] = sentResponse{
+		version:   resp.VersionInfo,
+		nonce:     resp.Nonce,
+		requested: req.GetResourceNames(),
+	}
+	c.mu.Unlock()
+
+	c.WithFields(logrus.Fields{
+		"stream":    id,
+		"node":      nodeID(s),
+		"type":      resp.TypeUrl,
+		"version":   resp.VersionInfo,
+		"nonce":     resp.Nonce,
+		"resources": len(resp.Resources),
+	}).Debug("response")
+}
+
+// OnDeltaStreamOpen implements serverv3.Callbacks.
+func (c *Callbacks) OnDeltaStreamOpen(_ context.Context, id int64, typeURL string) error {
+	c.mu.Lock()
+	c.deltaStreams[id] = &stream{typeURL: streamType(typeURL), sent: make(map[string]sentResponse)}
+	c.mu.Unlock()
+
+	metrics.Streams.WithLabelValues(streamType(typeURL)).Inc()
+	c.WithFields(logrus.Fields{"stream": id, "type": streamType(typeURL)}).Info("delta stream opened")
+	return nil
+}
+
+// OnDeltaStreamClosed implements serverv3.Callbacks.
+func (c *Callbacks) OnDeltaStreamClosed(id int64) {
+	c.mu.Lock()
+	s := c.deltaStreams[id]
+	delete(c.deltaStreams, id)
+	c.mu.Unlock()
+
+	if s != nil {
+		metrics.Streams.WithLabelValues(s.typeURL).Dec()
+	}
+	c.WithFields(logrus.Fields{"stream": id, "node": nodeID(s)}).Info("delta stream closed")
+}
+
+// OnStreamDeltaRequest implements serverv3.Callbacks.
+func (c *Callbacks) OnStreamDeltaRequest(id int64, req *discovery.DeltaDiscoveryRequest) error {
+	c.mu.Lock()
+	s := c.track(c.deltaStreams, id, req.Node)
+	last := s.sent[req.TypeUrl]
+	c.mu.Unlock()
+
+	log := c.WithFields(logrus.Fields{
+		"stream": id,
+		"node":   nodeID(s),
+		"type":   req.TypeUrl,
+		"nonce":  req.ResponseNonce,
+	})
+
+	switch {
+	case req.ErrorDetail != nil:
+		metrics.NACKs.WithLabelValues(nodeID(s)).Inc()
+		c.logNACK(log, last, req.ResponseNonce, req.ErrorDetail.Code, req.ErrorDetail.Message)
+	case req.ResponseNonce != "":
+		metrics.ACKs.WithLabelValues(nodeID(s)).Inc()
+		log.Debug("ACK")
+	default:
+		log.WithFields(logrus.Fields{
+			"subscribe":   req.ResourceNamesSubscribe,
+			"unsubscribe": req.ResourceNamesUnsubscribe,
+		}).Debug("request")
+	}
+	return nil
+}
+
+// OnStreamDeltaResponse implements serverv3.Callbacks.
+func (c *Callbacks) OnStreamDeltaResponse(id int64, req *discovery.DeltaDiscoveryRequest, resp *discovery.DeltaDiscoveryResponse) {
+	var names []string
+	for _, r := range resp.Resources {
+		names = append(names, r.Name)
+	}
+
+	c.mu.Lock()
+	s := c.track(c.deltaStreams, id, nil)
+	s.sent[resp.TypeUrl] = sentResponse{
+		version: resp.SystemVersionInfo,
+		nonce:   resp.Nonce,
+		names:   names,
+	}
+	c.mu.Unlock()
+
+	c.WithFields(logrus.Fields{
+		"stream":  id,
+		"node":    nodeID(s),
+		"type":    resp.TypeUrl,
+		"version": resp.SystemVersionInfo,
+		"nonce":   resp.Nonce,
+		"updated": len(names),
+		"removed": len(resp.RemovedResources),
+	}).Debug("delta response")
+}
+
+// OnFetchRequest implements serverv3.Callbacks.
+func (c *Callbacks) OnFetchRequest(_ context.Context, req *discovery.DiscoveryRequest) error {
+	c.WithFields(logrus.Fields{
+		"node":    req.GetNode().GetId(),
+		"type":    req.TypeUrl,
+		"version": req.VersionInfo,
+	}).Debug("fetch request")
+	return nil
+}
+
+// OnFetchResponse implements serverv3.Callbacks.
+func (c *Callbacks) OnFetchResponse(req *discovery.DiscoveryRequest, resp *discovery.DiscoveryResponse) {
+	c.WithFields(logrus.Fields{
+		"node":      req.GetNode().GetId(),
+		"type":      resp.TypeUrl,
+		"version":   resp.VersionInfo,
+		"resources": len(resp.Resources),
+	}).Debug("fetch response")
+}
+
+// logNACK logs a request rejecting a response. The resources are those of
+// the last response sent on the stream for the type, when it is the
+// rejected one.
+func (c *Callbacks) logNACK(log logrus.FieldLogger, last sentResponse, nonce string, code int32, message string) {
+	fields := logrus.Fields{"code": code}
+	if last.nonce == nonce {
+		fields["rejectedVersion"] = last.version
+		if last.names != nil {
+			fields["resources"] = last.names
+		}
+	}
+	log.WithFields(fields).Errorf("NACK: %s", message)
+}
+
+// sentNames returns the names of the resources in a state-of-the-world
+// response sent to node, or nil if the node's snapshot has moved on from
+// the response's version.
+func (c *Callbacks) sentNames(node *core.Node, typeURL string, sent sentResponse) []string {
+	snapshot, err := c.cache.GetSnapshot(c.nodeHash.ID(node))
+	if err != nil || snapshot.GetVersion(typeURL) != sent.version {
+		return nil
+	}
+
+	resources := snapshot.GetResources(typeURL)
+	names := []string{}
+	if len(sent.requested) == 0 {
+		for name := range resources {
+			names = append(names, name)
+		}
+	} else {
+		for _, name := range sent.requested {
+			if _, ok := resources[name]; ok {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// track returns the state of a stream, recording its node if it was sent.
+// It must be called with c.mu held.
+func (c *Callbacks) track(streams map[int64]*stream, id int64, node *core.Node) *stream {
+	s, ok := streams[id]
+	if !ok {
+		s = &stream{sent: make(map[string]sentResponse)}
+		streams[id] = s
+	}
+	if node != nil && s.node == nil {
+		s.node = node
+	}
+	return s
+}
+
+func nodeID(s *stream) string {
+	if s == nil || s.node == nil {
+		return ""
+	}
+	return s.node.Id
+}
+
+// streamType names the type of a stream, which is empty for ADS.
+func streamType(typeURL string) string {
+	if typeURL == "" {
+		return "ADS"
+	}
+	return typeURL
+}
@@ -0,0 +1,102 @@
+//   Copyright Steve Sloka 2021
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package server
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestNACKReportsRejectedResources(t *testing.T) {
+	snapshots := cache.NewSnapshotCache(false, cache.IDHash{}, nil)
+	snapshot, err := cache.NewSnapshot("2", map[resource.Type][]types.Resource{
+		resource.ClusterType: {&cluster.Cluster{Name: "saas"}, &cluster.Cluster{Name: "echo"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := snapshots.SetSnapshot(context.Background(), "edge-proxy-1", snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		requested []string
+		version   string
+		want      interface{}
+	}{
+		"every resource":    {version: "2", want: []string{"echo", "saas"}},
+		"requested":         {version: "2", requested: []string{"saas", "other"}, want: []string{"saas"}},
+		"snapshot moved on": {version: "1", want: nil},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			log, hook := test.NewNullLogger()
+			c := NewCallbacks(log, snapshots, cache.IDHash{})
+
+			c.OnStreamOpen(context.Background(), 1, resource.ClusterType)
+			req := &discovery.DiscoveryRequest{
+				Node:          &core.Node{Id: "edge-proxy-1"},
+				TypeUrl:       resource.ClusterType,
+				ResourceNames: tc.requested,
+			}
+			c.OnStreamRequest(1, req)
+			c.OnStreamResponse(context.Background(), 1, req, &discovery.DiscoveryResponse{
+				TypeUrl:     resource.ClusterType,
+				VersionInfo: tc.version,
+				Nonce:       "1",
+			})
+
+			nack := &discovery.DiscoveryRequest{}
+			if err := protojson.Unmarshal([]byte(`{
+				"typeUrl": "`+resource.ClusterType+`",
+				"responseNonce": "1",
+				"errorDetail": {"code": 3, "message": "bad cluster"}
+			}`), nack); err != nil {
+				t.Fatal(err)
+			}
+			c.OnStreamRequest(1, nack)
+
+			entry := hook.LastEntry()
+			if entry == nil || entry.Level != logrus.ErrorLevel {
+				t.Fatalf("last log entry = %+v, want a NACK error", entry)
+			}
+			if got, want := entry.Data["rejectedVersion"], tc.version; got != want {
+				t.Errorf("rejectedVersion = %v, want %v", got, want)
+			}
+			got, ok := entry.Data["resources"]
+			if tc.want == nil {
+				if ok {
+					t.Errorf("resources = %v, want none", got)
+				}
+			} else if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("resources = %v, want %v", got, tc.want)
+			}
+			if got, want := entry.Data["node"], "edge-proxy-1"; got != want {
+				t.Errorf("node = %v, want %v", got, want)
+			}
+		})
+	}
+}
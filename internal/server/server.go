@@ -16,11 +16,13 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
 	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
@@ -47,14 +49,26 @@ func registerServer(grpcServer *grpc.Server, server serverv3.Server) {
 	runtimeservice.RegisterRuntimeDiscoveryServiceServer(grpcServer, server)
 }
 
-// RunServer starts an xDS server at the given port.
-func RunServer(ctx context.Context, srv3 serverv3.Server, port uint) {
+// RunServer starts an xDS server at the given port. When tlsFiles is set
+// the server only accepts TLS connections, reloading the files as they
+// change.
+func RunServer(ctx context.Context, srv3 serverv3.Server, port uint, tlsFiles *TLSFiles) {
 	// gRPC golang library sets a very small upper bound for the number gRPC/h2
 	// streams over a single TCP connection. If a proxy multiplexes requests over
 	// a single connection to the management server, then it might lead to
 	// availability problems.
 	var grpcOptions []grpc.ServerOption
 	grpcOptions = append(grpcOptions, grpc.MaxConcurrentStreams(grpcMaxConcurrentStreams))
+
+	if tlsFiles != nil {
+		reloader, err := newCertReloader(*tlsFiles)
+		if err != nil {
+			log.Fatal(err)
+		}
+		grpcOptions = append(grpcOptions, grpc.Creds(credentials.NewTLS(&tls.Config{
+			GetConfigForClient: reloader.GetConfigForClient,
+		})))
+	}
 	grpcServer := grpc.NewServer(grpcOptions...)
 
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
@@ -0,0 +1,137 @@
+//   Copyright Steve Sloka 2021
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSFiles are the PEM files the management server serves TLS with.
+// ClientCAFile, when set, holds the CA bundle client certificates are
+// validated against, and RequireClientCert makes them mandatory.
+type TLSFiles struct {
+	CertFile          string
+	KeyFile           string
+	ClientCAFile      string
+	RequireClientCert bool
+}
+
+// certReloader serves the TLS config made from a set of TLSFiles, making
+// it again whenever one of the files has changed since it was last read.
+// Files are checked when a client connects, so a rotated certificate is
+// used from the next connection on.
+type certReloader struct {
+	files TLSFiles
+
+	mu      sync.Mutex
+	config  *tls.Config
+	modTime map[string]time.Time
+}
+
+func newCertReloader(files TLSFiles) (*certReloader, error) {
+	r := &certReloader{files: files}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetConfigForClient implements tls.Config.GetConfigForClient.
+func (r *certReloader) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.changed() {
+		if err := r.reload(); err != nil {
+			// Keep serving the previous files until the new ones are usable
+			log.Printf("error reloading server TLS files: %v\n", err)
+		} else {
+			log.Println("reloaded server TLS files")
+		}
+	}
+	return r.config, nil
+}
+
+// changed reports whether any of the files was modified since they were
+// last read.
+func (r *certReloader) changed() bool {
+	for _, file := range r.paths() {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(r.modTime[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *certReloader) reload() error {
+	modTime := make(map[string]time.Time)
+	for _, file := range r.paths() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTime[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2"},
+	}
+
+	if r.files.ClientCAFile != "" {
+		ca, err := ioutil.ReadFile(r.files.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("no certificates found in %s", r.files.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.files.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	r.config = config
+	r.modTime = modTime
+	return nil
+}
+
+func (r *certReloader) paths() []string {
+	paths := []string{r.files.CertFile, r.files.KeyFile}
+	if r.files.ClientCAFile != "" {
+		paths = append(paths, r.files.ClientCAFile)
+	}
+	return paths
+}
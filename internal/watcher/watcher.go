@@ -15,7 +15,13 @@
 package watcher
 
 import (
+	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
@@ -31,52 +37,211 @@ const (
 type NotifyMessage struct {
 	Operation OperationType
 	FilePath  string
+	// Time is when the change was seen.
+	Time time.Time
 }
 
-func Watch(directory string, notifyCh chan<- NotifyMessage) {
-	watcher, err := fsnotify.NewWatcher()
+// IsConfigFile reports whether path names a YAML config file.
+func IsConfigFile(path string) bool {
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// ConfigFiles returns the config files found at path. If path is a directory
+// every YAML file directly inside it is returned, otherwise path itself is,
+// and must be a YAML file for its changes to be seen as config changes.
+func ConfigFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer watcher.Close()
-
-	done := make(chan bool)
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-				if event.Op&fsnotify.Write == fsnotify.Write {
-					notifyCh <- NotifyMessage{
+	if !info.IsDir() {
+		if !IsConfigFile(path) {
+			return nil, fmt.Errorf("%s: config file must have a .yaml or .yml extension", path)
+		}
+		return []string{path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, e := range entries {
+		if e.IsDir() || !IsConfigFile(e.Name()) {
+			continue
+		}
+		files = append(files, filepath.Join(path, e.Name()))
+	}
+	return files, nil
+}
+
+// Watcher reports changes to the config files in a directory, and to the
+// files outside of them, such as certificates, that the configs refer to.
+type Watcher struct {
+	directory string
+	notifyCh  chan<- NotifyMessage
+	fsw       *fsnotify.Watcher
+
+	mu sync.Mutex
+	// files holds the referenced files being watched.
+	files map[string]bool
+	// dirs holds the directories watched for referenced files.
+	dirs map[string]bool
+}
+
+// New returns a Watcher for the config files at directory, which may also
+// be a single file.
+func New(directory string, notifyCh chan<- NotifyMessage) (*Watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	directory = filepath.Clean(directory)
+	if err := fsw.Add(directory); err != nil {
+		fsw.Close()
+		return nil, err
+	}
+
+	return &Watcher{
+		directory: directory,
+		notifyCh:  notifyCh,
+		fsw:       fsw,
+		files:     make(map[string]bool),
+		dirs:      make(map[string]bool),
+	}, nil
+}
+
+// WatchFiles sets the referenced files to watch, replacing those given
+// before. Their directories are watched rather than the files themselves,
+// so files that are replaced, instead of written to, are still followed.
+// A change to any of them is reported as a Modify.
+func (w *Watcher) WatchFiles(paths []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		files[path] = true
+		dirs[filepath.Dir(path)] = true
+	}
+
+	for dir := range dirs {
+		if w.dirs[dir] || dir == w.directory {
+			continue
+		}
+		if err := w.fsw.Add(dir); err != nil {
+			log.Println("error:", err)
+		}
+	}
+	for dir := range w.dirs {
+		if dirs[dir] || dir == w.directory {
+			continue
+		}
+		if err := w.fsw.Remove(dir); err != nil {
+			log.Println("error:", err)
+		}
+	}
+
+	w.files = files
+	w.dirs = dirs
+}
+
+// Run sends the changes it sees to the notify channel until the watcher
+// fails.
+func (w *Watcher) Run() {
+	defer w.fsw.Close()
+
+	for {
+		select {
+		case event, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+
+			if files := w.changedFiles(event); len(files) > 0 {
+				for _, file := range files {
+					w.notifyCh <- NotifyMessage{
 						Operation: Modify,
-						FilePath:  event.Name,
-					}
-				} else if event.Op&fsnotify.Create == fsnotify.Create {
-					notifyCh <- NotifyMessage{
-						Operation: Create,
-						FilePath:  event.Name,
-					}
-				} else if event.Op&fsnotify.Remove == fsnotify.Remove {
-					notifyCh <- NotifyMessage{
-						Operation: Remove,
-						FilePath:  event.Name,
+						FilePath:  file,
+						Time:      time.Now(),
 					}
 				}
+				continue
+			}
 
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
+			if !w.isConfigEvent(event.Name) {
+				continue
+			}
+			if event.Op&fsnotify.Write == fsnotify.Write {
+				w.notifyCh <- NotifyMessage{
+					Operation: Modify,
+					FilePath:  event.Name,
+					Time:      time.Now(),
+				}
+			} else if event.Op&fsnotify.Create == fsnotify.Create {
+				w.notifyCh <- NotifyMessage{
+					Operation: Create,
+					FilePath:  event.Name,
+					Time:      time.Now(),
+				}
+			} else if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				// A renamed file is gone from its old path
+				w.notifyCh <- NotifyMessage{
+					Operation: Remove,
+					FilePath:  event.Name,
+					Time:      time.Now(),
 				}
-				log.Println("error:", err)
 			}
+
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			log.Println("error:", err)
 		}
-	}()
+	}
+}
 
-	err = watcher.Add(directory)
-	if err != nil {
-		log.Fatal(err)
+// changedFiles returns the referenced files changed by an event.
+// Kubernetes updates mounted secrets by swapping the ..data symlink of
+// their directory, which changes every file in it.
+func (w *Watcher) changedFiles(event fsnotify.Event) []string {
+	if event.Op == fsnotify.Chmod {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	name := filepath.Clean(event.Name)
+	if w.files[name] {
+		return []string{name}
+	}
+
+	var files []string
+	if filepath.Base(name) == "..data" {
+		for file := range w.files {
+			if filepath.Dir(file) == filepath.Dir(name) {
+				files = append(files, file)
+			}
+		}
+	}
+	return files
+}
+
+// isConfigEvent reports whether path is a config file being watched.
+func (w *Watcher) isConfigEvent(path string) bool {
+	path = filepath.Clean(path)
+	if !IsConfigFile(path) {
+		return false
 	}
-	<-done
+	return path == w.directory || filepath.Dir(path) == w.directory
 }
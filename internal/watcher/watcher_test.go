@@ -0,0 +1,53 @@
+//   Copyright Steve Sloka 2021
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package watcher
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfigFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.yaml", "b.yml", "notes.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string]struct {
+		path    string
+		want    []string
+		wantErr bool
+	}{
+		"directory":     {path: dir, want: []string{filepath.Join(dir, "a.yaml"), filepath.Join(dir, "b.yml")}},
+		"yaml file":     {path: filepath.Join(dir, "a.yaml"), want: []string{filepath.Join(dir, "a.yaml")}},
+		"non-yaml file": {path: filepath.Join(dir, "notes.txt"), wantErr: true},
+		"missing":       {path: filepath.Join(dir, "missing.yaml"), wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ConfigFiles(tc.path)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ConfigFiles() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ConfigFiles() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -20,37 +20,47 @@ import (
 )
 
 type XDSCache struct {
-	Listeners map[string]resources.Listener
-	Routes    map[string]resources.Route
-	Clusters  map[string]resources.Cluster
-	Endpoints map[string]resources.Endpoint
+	Listeners    map[string]resources.Listener
+	RouteConfigs map[string]resources.RouteConfig
+	Clusters     map[string]resources.Cluster
+	Endpoints    map[string]resources.Endpoint
+	Secrets      map[string]resources.Secret
+	Runtimes     map[string]resources.RuntimeLayer
+
+	// ConfigSource is how the generated resources tell Envoy to fetch the
+	// resources they refer to.
+	ConfigSource resources.ConfigSource
 }
 
 func (xds *XDSCache) ClusterContents() []types.Resource {
 	var r []types.Resource
 
 	for _, c := range xds.Clusters {
-		r = append(r, resources.MakeCluster(c.Name))
+		r = append(r, resources.MakeCluster(c, xds.ConfigSource))
 	}
 
 	return r
 }
 
 func (xds *XDSCache) RouteContents() []types.Resource {
+	var r []types.Resource
 
-	var routesArray []resources.Route
-	for _, r := range xds.Routes {
-		routesArray = append(routesArray, r)
+	for _, rc := range xds.RouteConfigs {
+		r = append(r, resources.MakeRoute(rc.Name, rc.VirtualHosts))
 	}
 
-	return []types.Resource{resources.MakeRoute(routesArray)}
+	return r
 }
 
 func (xds *XDSCache) ListenerContents() []types.Resource {
 	var r []types.Resource
 
 	for _, l := range xds.Listeners {
-		r = append(r, resources.MakeHTTPListener(l.Name, l.RouteNames[0], l.Address, l.Port))
+		if l.Protocol == resources.ProtocolTCP {
+			r = append(r, resources.MakeTCPListener(l, xds.ConfigSource))
+			continue
+		}
+		r = append(r, resources.MakeHTTPListener(l, xds.ConfigSource))
 	}
 
 	return r
@@ -60,42 +70,91 @@ func (xds *XDSCache) EndpointsContents() []types.Resource {
 	var r []types.Resource
 
 	for _, c := range xds.Clusters {
+		// Other clusters embed their endpoints
+		if !resources.IsEDSCluster(c) {
+			continue
+		}
 		r = append(r, resources.MakeEndpoint(c.Name, c.Endpoints))
 	}
 
 	return r
 }
 
-func (xds *XDSCache) AddListener(name string, routeNames []string, address string, port uint32) {
-	xds.Listeners[name] = resources.Listener{
-		Name:       name,
-		Address:    address,
-		Port:       port,
-		RouteNames: routeNames,
+func (xds *XDSCache) SecretContents() []types.Resource {
+	var r []types.Resource
+
+	for _, s := range xds.Secrets {
+		r = append(r, resources.MakeSecret(s))
+	}
+
+	return r
+}
+
+func (xds *XDSCache) RuntimeContents() []types.Resource {
+	var r []types.Resource
+
+	for _, l := range xds.Runtimes {
+		r = append(r, resources.MakeRuntime(l))
 	}
+
+	return r
 }
 
-func (xds *XDSCache) AddRoute(name, prefix string, clusters []string) {
-	xds.Routes[name] = resources.Route{
-		Name:    name,
-		Prefix:  prefix,
-		Cluster: clusters[0],
+// AddListener adds a listener. HTTP listeners are added along with the
+// route configuration, named after the listener, that holds their routes.
+func (xds *XDSCache) AddListener(listener resources.Listener) {
+	if listener.Protocol == resources.ProtocolTCP {
+		xds.Listeners[listener.Name] = listener
+		return
+	}
+
+	listener.RouteConfigName = listener.Name
+	xds.Listeners[listener.Name] = listener
+
+	xds.RouteConfigs[listener.Name] = resources.RouteConfig{
+		Name: listener.Name,
 	}
 }
 
-func (xds *XDSCache) AddCluster(name string) {
-	xds.Clusters[name] = resources.Cluster{
-		Name: name,
+// AddVirtualHost adds a virtual host to a listener's route configuration.
+func (xds *XDSCache) AddVirtualHost(listenerName string, vh resources.VirtualHost) {
+	rc := xds.RouteConfigs[listenerName]
+
+	rc.VirtualHosts = append(rc.VirtualHosts, vh)
+
+	xds.RouteConfigs[listenerName] = rc
+}
+
+// AddRoute appends a route to a virtual host of a listener's route
+// configuration. Routes are matched in the order they are added.
+func (xds *XDSCache) AddRoute(listenerName, virtualHostName string, route resources.Route) {
+	rc := xds.RouteConfigs[listenerName]
+
+	for i := range rc.VirtualHosts {
+		if rc.VirtualHosts[i].Name == virtualHostName {
+			rc.VirtualHosts[i].Routes = append(rc.VirtualHosts[i].Routes, route)
+		}
 	}
+
+	xds.RouteConfigs[listenerName] = rc
+}
+
+func (xds *XDSCache) AddCluster(cluster resources.Cluster) {
+	xds.Clusters[cluster.Name] = cluster
+}
+
+func (xds *XDSCache) AddSecret(secret resources.Secret) {
+	xds.Secrets[secret.Name] = secret
+}
+
+func (xds *XDSCache) AddRuntimeLayer(layer resources.RuntimeLayer) {
+	xds.Runtimes[layer.Name] = layer
 }
 
-func (xds *XDSCache) AddEndpoint(clusterName, upstreamHost string, upstreamPort uint32) {
+func (xds *XDSCache) AddEndpoint(clusterName string, endpoint resources.Endpoint) {
 	cluster := xds.Clusters[clusterName]
 
-	cluster.Endpoints = append(cluster.Endpoints, resources.Endpoint{
-		UpstreamHost: upstreamHost,
-		UpstreamPort: upstreamPort,
-	})
+	cluster.Endpoints = append(cluster.Endpoints, endpoint)
 
 	xds.Clusters[clusterName] = cluster
 }
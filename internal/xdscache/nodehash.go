@@ -0,0 +1,195 @@
+//   Copyright Steve Sloka 2021
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package xdscache
+
+import (
+	"sync"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/stevesloka/envoy-xds-server/internal/resources"
+)
+
+// DefaultNodeGroup is the snapshot group served to nodes that are not
+// selected by ID or cluster in any config.
+const DefaultNodeGroup = "default"
+
+// NodeIDGroup returns the snapshot group for nodes with the given ID.
+func NodeIDGroup(id string) string {
+	return "node/" + id
+}
+
+// NodeClusterGroup returns the snapshot group for nodes in the given
+// Envoy node cluster.
+func NodeClusterGroup(cluster string) string {
+	return "cluster/" + cluster
+}
+
+// The node metadata fields a node chooses its config source with.
+const (
+	// MetadataConfigSource is one of ads, grpc or delta_grpc.
+	MetadataConfigSource = "xds_config_source"
+	// MetadataXDSCluster names the cluster this server is reached through.
+	MetadataXDSCluster = "xds_cluster"
+)
+
+// SnapshotKey returns the key of the snapshot served to a group of nodes
+// using the config source with the given key. Nodes using the default
+// config source, with the empty key, are served the group's own snapshot.
+func SnapshotKey(group, source string) string {
+	if source == "" {
+		return group
+	}
+	return group + "@" + source
+}
+
+// NodeHash maps an Envoy node to the snapshot group it is served from.
+// A node selected by ID is served that group, otherwise a node whose
+// cluster is selected is served the cluster's group, and any other node
+// is served the DefaultNodeGroup.
+//
+// Nodes are served resources referring them to ConfigSource, unless their
+// metadata chooses another config source, in which case they are served a
+// snapshot of their group made for that config source. Nodes can only
+// choose the cluster of ConfigSource or one of the allowed clusters, which
+// bounds the snapshots made for them.
+type NodeHash struct {
+	ConfigSource resources.ConfigSource
+
+	// clusters holds the other clusters nodes may choose.
+	clusters map[string]bool
+
+	mu     sync.RWMutex
+	groups map[string]bool
+	// sources holds the config sources chosen by nodes, by key.
+	sources map[string]resources.ConfigSource
+	added   chan struct{}
+}
+
+// NewNodeHash returns a NodeHash serving configSource by default, letting
+// nodes choose the cluster of configSource or one of allowedClusters.
+func NewNodeHash(configSource resources.ConfigSource, allowedClusters []string) *NodeHash {
+	clusters := make(map[string]bool)
+	for _, name := range allowedClusters {
+		clusters[name] = true
+	}
+
+	return &NodeHash{
+		ConfigSource: configSource,
+		clusters:     clusters,
+		sources:      make(map[string]resources.ConfigSource),
+		added:        make(chan struct{}, 1),
+	}
+}
+
+// ID implements cache.NodeHash.
+func (h *NodeHash) ID(node *core.Node) string {
+	if node == nil {
+		return DefaultNodeGroup
+	}
+
+	return SnapshotKey(h.group(node), h.source(node))
+}
+
+func (h *NodeHash) group(node *core.Node) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if group := NodeIDGroup(node.Id); h.groups[group] {
+		return group
+	}
+	if group := NodeClusterGroup(node.Cluster); h.groups[group] {
+		return group
+	}
+	return DefaultNodeGroup
+}
+
+// source returns the key of the config source a node's metadata chooses,
+// recording it if it is new. Metadata that is missing, or names an unknown
+// config source or a cluster that is not allowed, leaves the default in
+// place.
+func (h *NodeHash) source(node *core.Node) string {
+	cs := h.ConfigSource
+	fields := node.GetMetadata().GetFields()
+	switch fields[MetadataConfigSource].GetStringValue() {
+	case "ads":
+		cs = resources.ConfigSource{ADS: true}
+	case "grpc":
+		cs = resources.ConfigSource{ClusterName: h.ConfigSource.ClusterName}
+	case "delta_grpc":
+		cs = resources.ConfigSource{Delta: true, ClusterName: h.ConfigSource.ClusterName}
+	}
+	if name := fields[MetadataXDSCluster].GetStringValue(); name != "" && !cs.ADS {
+		if name == h.ConfigSource.ClusterName || h.clusters[name] {
+			cs.ClusterName = name
+		}
+	}
+
+	if cs == h.ConfigSource {
+		return ""
+	}
+	key := configSourceKey(cs)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.sources[key]; !ok {
+		h.sources[key] = cs
+		select {
+		case h.added <- struct{}{}:
+		default:
+		}
+	}
+	return key
+}
+
+func configSourceKey(cs resources.ConfigSource) string {
+	switch {
+	case cs.ADS:
+		return "ads"
+	case cs.Delta:
+		return "delta_grpc/" + cs.ClusterName
+	}
+	return "grpc/" + cs.ClusterName
+}
+
+// ConfigSources returns the config sources to make snapshots for, by key.
+// The default config source has the empty key.
+func (h *NodeHash) ConfigSources() map[string]resources.ConfigSource {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	sources := map[string]resources.ConfigSource{"": h.ConfigSource}
+	for key, cs := range h.sources {
+		sources[key] = cs
+	}
+	return sources
+}
+
+// Added is signalled when a node chooses a config source that has not been
+// chosen before, so that snapshots can be made for it.
+func (h *NodeHash) Added() <-chan struct{} {
+	return h.added
+}
+
+// SetGroups replaces the set of snapshot groups nodes can be mapped to.
+func (h *NodeHash) SetGroups(groups []string) {
+	g := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		g[group] = true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.groups = g
+}
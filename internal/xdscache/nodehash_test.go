@@ -0,0 +1,95 @@
+//   Copyright Steve Sloka 2021
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package xdscache
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	_struct "github.com/golang/protobuf/ptypes/struct"
+	"github.com/stevesloka/envoy-xds-server/internal/resources"
+)
+
+func TestNodeHashID(t *testing.T) {
+	h := NewNodeHash(resources.ConfigSource{ClusterName: resources.DefaultXDSCluster}, nil)
+	h.SetGroups([]string{DefaultNodeGroup, NodeIDGroup("x"), NodeClusterGroup("edge")})
+
+	tests := map[string]struct {
+		node *core.Node
+		want string
+	}{
+		"nil node":         {node: nil, want: DefaultNodeGroup},
+		"selected id":      {node: &core.Node{Id: "x", Cluster: "edge"}, want: NodeIDGroup("x")},
+		"selected cluster": {node: &core.Node{Id: "y", Cluster: "edge"}, want: NodeClusterGroup("edge")},
+		"not selected":     {node: &core.Node{Id: "y", Cluster: "other"}, want: DefaultNodeGroup},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := h.ID(tc.node); got != tc.want {
+				t.Errorf("ID() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	// Withdrawing a group re-hashes its nodes
+	h.SetGroups([]string{DefaultNodeGroup, NodeClusterGroup("edge")})
+	if got, want := h.ID(&core.Node{Id: "x", Cluster: "edge"}), NodeClusterGroup("edge"); got != want {
+		t.Errorf("ID() after withdrawing node/x = %q, want %q", got, want)
+	}
+}
+
+func TestNodeHashConfigSources(t *testing.T) {
+	h := NewNodeHash(resources.ConfigSource{ClusterName: resources.DefaultXDSCluster}, []string{"management"})
+	h.SetGroups([]string{DefaultNodeGroup})
+
+	tests := map[string]struct {
+		source, cluster string
+		want            string
+	}{
+		"no metadata":         {want: DefaultNodeGroup},
+		"unknown source":      {source: "rest", want: DefaultNodeGroup},
+		"ads":                 {source: "ads", want: SnapshotKey(DefaultNodeGroup, "ads")},
+		"delta":               {source: "delta_grpc", want: SnapshotKey(DefaultNodeGroup, "delta_grpc/"+resources.DefaultXDSCluster)},
+		"allowed cluster":     {source: "grpc", cluster: "management", want: SnapshotKey(DefaultNodeGroup, "grpc/management")},
+		"not allowed cluster": {source: "grpc", cluster: "other", want: DefaultNodeGroup},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			fields := make(map[string]*_struct.Value)
+			if tc.source != "" {
+				fields[MetadataConfigSource] = &_struct.Value{Kind: &_struct.Value_StringValue{StringValue: tc.source}}
+			}
+			if tc.cluster != "" {
+				fields[MetadataXDSCluster] = &_struct.Value{Kind: &_struct.Value_StringValue{StringValue: tc.cluster}}
+			}
+			node := &core.Node{Id: "x", Metadata: &_struct.Struct{Fields: fields}}
+			if got := h.ID(node); got != tc.want {
+				t.Errorf("ID() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	var keys []string
+	for key := range h.ConfigSources() {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	want := []string{"", "ads", "delta_grpc/" + resources.DefaultXDSCluster, "grpc/management"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("ConfigSources() keys = %v, want %v", keys, want)
+	}
+}